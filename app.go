@@ -4,8 +4,12 @@ import (
 	storage "AstroMail/config"
 	emailparser "AstroMail/email-parser"
 	smtpstack "AstroMail/smtp-stack"
+	"errors"
 	"fmt"
+	"net/mail"
 	"strings"
+	"sync"
+	"time"
 
 	// "AstroMail/storage"
 	"context"
@@ -17,8 +21,32 @@ import (
 type App struct {
 	ctx     context.Context
 	sending bool
+	store   *storage.Store
+
+	// syncing is held while the inbox syncs, so two syncs never run at once.
+	syncing sync.Mutex
+	// syncCtx is cancelled on shutdown to stop the sync in progress and the
+	// background sync loop.
+	syncCtx  context.Context
+	stopSync context.CancelFunc
+	syncLoop sync.WaitGroup
 }
 
+// errStoreNotOpen is returned by bindings that need the mail database when it
+// could not be opened at startup.
+var errStoreNotOpen = errors.New("mail database is not open")
+
+// errSyncRunning is returned by syncInbox when another sync has not finished.
+var errSyncRunning = errors.New("inbox sync already running")
+
+// maxSyncBackoff is the longest the background sync waits after failing,
+// such as while offline.
+const maxSyncBackoff = 30 * time.Minute
+
+// fallbackListInterval is how often the bucket is listed when new mail is
+// announced through the notification queue.
+const fallbackListInterval = time.Hour
+
 // NewApp creates a new App application struct
 func NewApp() *App {
 	return &App{}
@@ -30,49 +58,192 @@ func (a *App) startup(ctx context.Context) {
 	a.sending = false
 	storage.CreateConfig()
 	a.ctx = ctx
+	a.syncCtx, a.stopSync = context.WithCancel(ctx)
+
+	path, err := storage.StorePath()
+	if err == nil {
+		a.store, err = storage.OpenStore(path, searchText)
+	}
+	if err != nil {
+		fmt.Println("Failed to open mail database: ", err)
+		return
+	}
+
+	expired, err := a.store.ExpireTrash(time.Duration(storage.TrashDays()) * 24 * time.Hour)
+	if err != nil {
+		fmt.Println("Failed to empty trash: ", err)
+	} else if expired > 0 {
+		fmt.Printf("Deleted %d messages from the trash\n", expired)
+	}
+
+	a.syncLoop.Add(2)
+	go a.syncPeriodically(a.syncCtx)
+	go a.receiveNotifications(a.syncCtx)
+}
+
+// shutdown is called when the app is closing.
+func (a *App) shutdown(ctx context.Context) {
+	// Stop syncing before the database closes under it
+	if a.stopSync != nil {
+		a.stopSync()
+	}
+	a.syncLoop.Wait()
+	a.syncing.Lock()
+	defer a.syncing.Unlock()
+
+	if a.store != nil {
+		if err := a.store.Close(); err != nil {
+			fmt.Println("Failed to close mail database: ", err)
+		}
+	}
+}
+
+// Launch SMTP Server provisions the AWS stack for the domain. Progress is
+// reported through ProvisionProgress events; if setup stops part way, calling
+// it again with the same domain resumes from the step that did not finish.
+// SES receipt rules are only changed once confirm_rules is true: until then
+// setup stops with a NeedsConfirmation progress event describing the change.
+// rule_after places AstroMail's rule after that rule in an existing rule set.
+func (a *App) Launch_Smtp_Server(username, domain, aws_id, aws_secret, rule_after string, confirm_rules bool) error {
+	if aws_id != "" && aws_secret != "" {
+		if err := storage.AddAWSProfile(aws_id, aws_secret); err != nil {
+			return err
+		}
+	}
+
+	rules := smtpstack.ReceiptRuleOptions{After: rule_after, Confirmed: confirm_rules}
+	err := smtpstack.Provision(a.ctx, username, domain, rules, func(progress smtpstack.ProvisionProgress) {
+		runtime.EventsEmit(a.ctx, "ProvisionProgress", progress)
+	})
+	if errors.Is(err, smtpstack.ErrReceiptRulesNotConfirmed) {
+		return err
+	}
+	if err != nil {
+		fmt.Println("Provisioning failed: ", err)
+		runtime.EventsEmit(a.ctx, "ProvisionFail", err.Error())
+		return err
+	}
+
+	runtime.EventsEmit(a.ctx, "Provisioned")
+	return nil
+}
+
+// Configure AWS saves the region, shared credentials profile and optional
+// endpoint URL every AWS client is created with. Empty values fall back to
+// the defaults. The region must be one where SES can receive email.
+func (a *App) Configure_AWS(region, profile, endpoint string) error {
+	if region != "" {
+		if err := smtpstack.ValidateRegion(region); err != nil {
+			return err
+		}
+	}
+
+	settings := map[string]string{"Region": region, "Profile": profile, "Endpoint": endpoint}
+	for key, value := range settings {
+		if err := storage.WriteKeyToFile(key, value, storage.ConfigFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Configure Transport sets how mail from identity is sent: through the SES
+// API, an SMTP submission server or into a directory of .eml files. An empty
+// identity sets the default for every identity without its own transport.
+func (a *App) Configure_Transport(identity string, settings storage.TransportSettings) error {
+	switch settings.Type {
+	case storage.TransportSES, storage.TransportSMTP, storage.TransportFile:
+	default:
+		return fmt.Errorf("unknown transport type %q", settings.Type)
+	}
+	return storage.WriteTransportSettings(identity, settings)
 }
 
-// Launch SMTP Server
-func (a *App) Launch_Smtp_Server(username, domain, aws_id, aws_secret string) {
-	// fmt.Println(domain, aws_id, aws_secret)
-	// storage.WriteKeyToFile("Username", username, "Config.Json")
-	storage.AddAWSProfile(aws_id, aws_secret)
-	// bucket, _ := smtpstack.CreateEmailBucket(domain)
+// Teardown SMTP Server removes everything Launch_Smtp_Server created in AWS.
+// If exportDir is not empty the mail in the bucket is downloaded there first.
+// Progress is reported through DeprovisionProgress events.
+func (a *App) Teardown_Smtp_Server(exportDir string) error {
+	err := smtpstack.Deprovision(a.ctx, smtpstack.DeprovisionOptions{ExportDir: exportDir}, func(progress smtpstack.ProvisionProgress) {
+		runtime.EventsEmit(a.ctx, "DeprovisionProgress", progress)
+	})
+	if err != nil {
+		fmt.Println("Teardown failed: ", err)
+		runtime.EventsEmit(a.ctx, "DeprovisionFail", err.Error())
+		return err
+	}
 
-	// storage.WriteKeyToFile("Bucket", bucket, "Config.Json")
-	// storage.WriteKeyToFile("Bucket Status", "Created", "Config.Json")
-	// storage.WriteKeyToFile("Domain", domain, "Config.Json")
-	// storage.WriteKeyToFile("Domain Status", "Verifying", "Config.Json")
-	// fmt.Println("bucket created: ", bucket)
-	// verificationStatus, _ := smtpstack.IsDomainVerified(domain)
-	// storage.WriteKeyToFile("Domain Status", "Verified", "Config.Json")
-	// fmt.Println("Verification Status: ", verificationStatus)
+	runtime.EventsEmit(a.ctx, "Deprovisioned")
+	return nil
+}
 
-	// roleArn, err := smtpstack.CreateSESPolicyAndRole(domain, bucket)
-	// storage.WriteKeyToFile("RoleArn", roleArn, "Config.Json")
-	// fmt.Println("CreateSESPolicyAndRole failed: ", err)
+// Get DNS Records returns the records the user has to publish for the
+// configured domain.
+func (a *App) Get_DNS_Records() ([]smtpstack.DNSRecord, error) {
+	domain, err := storage.ReadKeyFromFile(storage.ConfigFile, "Domain")
+	if err != nil {
+		return nil, err
+	}
+	return smtpstack.DomainDNSRecords(domain)
+}
 
-	// err = smtpstack.ConfigureSESReceiptRules(domain, username, roleArn, bucket)
+// Export DNS Records returns the records for the configured domain as a BIND
+// zone file fragment ("bind") or as JSON ("json") for copying.
+func (a *App) Export_DNS_Records(format string) (string, error) {
+	records, err := a.Get_DNS_Records()
+	if err != nil {
+		return "", err
+	}
 
-	// fmt.Println("Configure ses rec failed: ", err)
-	// if err != nil {
-	// 	return
-	// }
-	// storage.WriteKeyToFile("Status", "Working", "Config.Json")
+	switch format {
+	case "bind":
+		return smtpstack.ZoneFile(records), nil
+	case "json":
+		return smtpstack.RecordsJSON(records)
+	}
+	return "", fmt.Errorf("unknown DNS record format %q", format)
 }
 
-// Send email Server
-func (a *App) Send_Email(to string, subject string, body string) {
-	username, err := storage.ReadKeyFromFile("Config.Json", "Username")
-	domain, err := storage.ReadKeyFromFile("Config.Json", "Domain")
-	fmt.Println(to, body, username+"@"+domain)
+// Send email Server. Attachments are given either by path, as returned by
+// Choose_Attachments, or by content.
+func (a *App) Send_Email(to string, subject string, body string, attachments []emailparser.OutgoingAttachment) {
+	a.send(func(sender string) error {
+		return smtpstack.SendEmail(a.store, sender, subject, body, []string{to}, []string{}, attachments)
+	})
+}
+
+// Reply_Email replies to the stored message with the given Message-ID,
+// quoting it below body. all replies to every recipient of the original.
+func (a *App) Reply_Email(messageID string, body string, all bool, attachments []emailparser.OutgoingAttachment) {
+	a.send(func(sender string) error {
+		return smtpstack.SendReply(a.store, sender, messageID, body, all, attachments)
+	})
+}
+
+// Forward_Email forwards the stored message with the given Message-ID and
+// its attachments to the comma separated addresses in to.
+func (a *App) Forward_Email(messageID string, to string, body string, attachments []emailparser.OutgoingAttachment) {
+	a.send(func(sender string) error {
+		return smtpstack.SendForward(a.store, sender, messageID, body, splitAddresses(to), attachments)
+	})
+}
+
+// send runs send with the configured address unless a message is already
+// being sent, reporting the outcome through the Sent, SendFail and Sending
+// events.
+func (a *App) send(send func(sender string) error) {
+	username, _ := storage.ReadKeyFromFile("Config.Json", "Username")
+	domain, _ := storage.ReadKeyFromFile("Config.Json", "Domain")
 
 	if a.sending == false {
 		a.sending = true
-		err = smtpstack.SendEmail(username+"@"+domain, subject, body, []string{to}, []string{})
+		err := errStoreNotOpen
+		if a.store != nil {
+			err = send(username + "@" + domain)
+		}
 		if err != nil {
 			// Handle the error and emit an error event if needed
-			runtime.EventsEmit(a.ctx, "SendFail")
+			fmt.Println("Send failed: ", err)
+			runtime.EventsEmit(a.ctx, "SendFail", err.Error())
 			a.sending = false
 			return
 		}
@@ -82,62 +253,412 @@ func (a *App) Send_Email(to string, subject string, body string) {
 	}
 
 	runtime.EventsEmit(a.ctx, "Sending")
-	return
 }
 
-// Greet returns a greeting for the given name
+func splitAddresses(addresses string) []string {
+	var split []string
+	for _, address := range strings.Split(addresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			split = append(split, address)
+		}
+	}
+	return split
+}
+
+// Choose_Attachments opens a file dialog and returns the paths of the files
+// the user picked.
+func (a *App) Choose_Attachments() ([]string, error) {
+	return runtime.OpenMultipleFilesDialog(a.ctx, runtime.OpenDialogOptions{
+		Title: "Attach files",
+	})
+}
+
+// Refresh_Inbox fetches the mail that arrived in the bucket since the last
+// refresh into the inbox. It returns at once if a sync is already running.
 func (a *App) Refresh_Inbox() {
 	fmt.Println("Refresh inbox")
+	if a.store == nil {
+		fmt.Println(errStoreNotOpen)
+		return
+	}
+	if err := a.syncInbox(a.syncCtx); err != nil {
+		fmt.Println("Failed to sync inbox: ", err)
+	}
+}
+
+// MailSummary describes a newly arrived message for the NewMail event.
+type MailSummary struct {
+	Key     string    `json:"key"`
+	From    string    `json:"from"`
+	Subject string    `json:"subject"`
+	Date    time.Time `json:"date"`
+}
+
+// NewMail is the payload of the NewMail event.
+type NewMail struct {
+	Messages []MailSummary `json:"messages"`
+	// Notify is set when the user wants a desktop notification.
+	Notify bool `json:"notify"`
+}
+
+// syncInbox runs one inbox sync unless another is running, emitting
+// SyncProgress while it downloads and NewMail when messages arrived.
+func (a *App) syncInbox(ctx context.Context) error {
+	if !a.syncing.TryLock() {
+		return errSyncRunning
+	}
+	defer a.syncing.Unlock()
+
 	bucket, _ := storage.ReadKeyFromFile("Config.Json", "Bucket")
-	objectNames, _ := smtpstack.ReadBucketFolderContent(bucket, "email", 1)
-	for _, filePath := range objectNames {
-		filepathSplit := strings.Split(filePath, "/")
-		messageId := filepathSplit[1]
-		if messageId != "AMAZON_SES_SETUP_NOTIFICATION" {
-			content, err := smtpstack.GetObjectContentAsString(bucket, filePath)
+	if bucket == "" {
+		// Nothing to sync until the stack is set up
+		return nil
+	}
+
+	var arrived []MailSummary
+	result, err := smtpstack.SyncInbox(ctx, a.store, bucket, a.syncOptions(&arrived))
+	a.finishSync(result, arrived)
+	return err
+}
+
+// syncQueued saves the mail announced by notifications from queue, like
+// syncInbox. If another sync is running the notifications are left in the
+// queue, which delivers them again.
+func (a *App) syncQueued(ctx context.Context, queue *smtpstack.MailQueue, mails []smtpstack.QueuedMail) error {
+	if !a.syncing.TryLock() {
+		return errSyncRunning
+	}
+	defer a.syncing.Unlock()
+
+	bucket, _ := storage.ReadKeyFromFile("Config.Json", "Bucket")
+	var arrived []MailSummary
+	result, err := smtpstack.SyncQueued(ctx, a.store, bucket, queue, mails, a.syncOptions(&arrived))
+	a.finishSync(result, arrived)
+	return err
+}
+
+// syncOptions threads new messages and adds their summaries to arrived.
+func (a *App) syncOptions(arrived *[]MailSummary) smtpstack.SyncOptions {
+	return smtpstack.SyncOptions{
+		Concurrency: storage.SyncConcurrency(),
+		Retention:   storage.Retention(),
+		Saved: func(key, eml string) {
+			email, err := emailparser.ParseEmail(eml)
 			if err != nil {
-				fmt.Printf("Error reading object %s: %v\n", filePath, err)
-				continue
+				fmt.Printf("Failed to parse new message %s: %v\n", key, err)
+				return
 			}
-			err = storage.SaveEmail(messageId, content, "inbox")
-			if err != nil {
-				fmt.Println(err)
+			if err := a.store.IndexThread(threadMessage(storage.FolderInbox, key, email)); err != nil {
+				fmt.Println("Failed to index thread: ", err)
+			}
+			*arrived = append(*arrived, mailSummary(key, email))
+		},
+		Progress: func(progress smtpstack.SyncProgress) {
+			runtime.EventsEmit(a.ctx, "SyncProgress", progress)
+		},
+	}
+}
+
+func (a *App) finishSync(result *smtpstack.SyncResult, arrived []MailSummary) {
+	if result != nil && result.Saved > 0 {
+		a.emitFolderCounts(storage.FolderInbox)
+	}
+	if len(arrived) > 0 {
+		runtime.EventsEmit(a.ctx, "NewMail", NewMail{Messages: arrived, Notify: storage.NotificationsEnabled()})
+	}
+}
+
+// syncPeriodically syncs the inbox every sync interval until ctx is
+// cancelled. After a failed sync it waits twice as long each time, up to
+// maxSyncBackoff, so it does not spin while offline.
+func (a *App) syncPeriodically(ctx context.Context) {
+	defer a.syncLoop.Done()
+
+	if storage.SyncInterval() <= 0 {
+		return
+	}
+	delay := listInterval()
+	for {
+		if !sleep(ctx, delay) {
+			return
+		}
+
+		err := a.syncInbox(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil, errors.Is(err, errSyncRunning):
+			delay = listInterval()
+		default:
+			fmt.Println("Background sync failed: ", err)
+			if delay *= 2; delay > maxSyncBackoff {
+				delay = maxSyncBackoff
+			}
+		}
+	}
+}
+
+// listInterval is how long syncPeriodically waits between listings of the
+// bucket. With a notification queue set up, listing only catches what the
+// queue missed and runs at most hourly.
+func listInterval() time.Duration {
+	interval := storage.SyncInterval()
+	if queueURL, _ := storage.ReadKeyFromFile("Config.Json", "Queue Url"); queueURL != "" && interval < fallbackListInterval {
+		interval = fallbackListInterval
+	}
+	return interval
+}
+
+// receiveNotifications long-polls the notification queue and saves new mail
+// as SES announces it, until ctx is cancelled. It waits for the queue to be
+// set up and backs off like syncPeriodically while offline.
+func (a *App) receiveNotifications(ctx context.Context) {
+	defer a.syncLoop.Done()
+
+	var queue *smtpstack.MailQueue
+	var queueURL string
+	delay := time.Second
+	for ctx.Err() == nil {
+		url, _ := storage.ReadKeyFromFile("Config.Json", "Queue Url")
+		if url == "" {
+			if !sleep(ctx, time.Minute) {
+				return
+			}
+			continue
+		}
+		if queue == nil || url != queueURL {
+			var err error
+			if queue, err = smtpstack.NewMailQueue(ctx, url); err != nil {
+				fmt.Println("Failed to open notification queue: ", err)
+				queue = nil
+				if !sleep(ctx, maxSyncBackoff) {
+					return
+				}
 				continue
 			}
-			_, err = emailparser.ParseEmail(content)
+			queueURL = url
 		}
 
+		mails, err := queue.Receive(ctx)
+		if err == nil && len(mails) > 0 {
+			err = a.syncQueued(ctx, queue, mails)
+		}
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil, errors.Is(err, errSyncRunning):
+			delay = time.Second
+		default:
+			fmt.Println("Failed to receive new mail: ", err)
+			if !sleep(ctx, delay) {
+				return
+			}
+			if delay *= 2; delay > maxSyncBackoff {
+				delay = maxSyncBackoff
+			}
+		}
+	}
+}
+
+// sleep waits for d and reports whether ctx is still live.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func mailSummary(key string, email *emailparser.Email) MailSummary {
+	summary := MailSummary{Key: key, Subject: email.Subject, Date: email.Date}
+	if email.From != nil {
+		summary.From = email.From.Name
+		if summary.From == "" {
+			summary.From = email.From.Address
+		}
 	}
+	return summary
+}
+
+// pageSize is the number of messages Get_Items returns at a time.
+const pageSize = 15
+
+// MailPage is one page of a folder with the folder's counts.
+type MailPage struct {
+	Items []MailItem `json:"items"`
+	// Next is the cursor to pass to Get_Items for the following page, or ""
+	// on the last page.
+	Next   string `json:"next"`
+	Total  int    `json:"total"`
+	Unread int    `json:"unread"`
+}
+
+// MailItem is a parsed message with where and when it was stored.
+type MailItem struct {
+	*emailparser.Email
+	Folder   string    `json:"folder"`
+	Key      string    `json:"key"`
+	Received time.Time `json:"received"`
+	Flags    []string  `json:"flags"`
+	Labels   []string  `json:"labels"`
+	Seen     bool      `json:"seen"`
+}
 
-	// emails, err := storage.RetrieveEmailsPaginated("inbox", 1, 50)
-	// var inbox []string
-	// for _, email := range emails {
-	// 	emailObj, _ := emailparser.ParseEmail(email)
-	// 	inbox = append(inbox, emailObj)
-	// }
+// Get_Items returns the page of messages in folder after cursor, newest
+// first unless oldest_first is set. An empty cursor returns the first page.
+func (a *App) Get_Items(folder string, cursor string, oldest_first bool) (*MailPage, error) {
+	if a.store == nil {
+		return nil, errStoreNotOpen
+	}
+	page, err := a.store.RetrievePage(folder, cursor, pageSize, oldest_first)
+	if err != nil {
+		return nil, err
+	}
 
-	// if err != nil {
-	// 	return inbox
-	// }
+	mailPage := &MailPage{
+		Items:  make([]MailItem, 0, len(page.Emails)),
+		Next:   page.Next,
+		Total:  page.Total,
+		Unread: page.Unread,
+	}
+	for _, stored := range page.Emails {
+		stored.Folder = folder
+		item := newMailItem(stored)
+		mailPage.Items = append(mailPage.Items, item)
+	}
+	return mailPage, nil
+}
 
-	// return inbox
+// newMailItem parses a stored message for a listing.
+func newMailItem(stored storage.StoredEmail) MailItem {
+	return MailItem{
+		Email:    parseListed(stored.Key, stored.EML),
+		Folder:   stored.Folder,
+		Key:      stored.Key,
+		Received: stored.Received,
+		Flags:    stored.Flags,
+		Labels:   stored.Labels,
+		Seen:     hasFlag(stored.Flags, storage.FlagSeen),
+	}
 }
 
-func (a *App) Get_Items(folder string, page int) []string {
-	fmt.Println("Page: ", page)
-	emails, err := storage.RetrieveEmailsPaginated(folder, page, 15)
-	var items []string
-	for _, email := range emails {
-		fmt.Println(email)
-		emailObj, _ := emailparser.ParseEmail(email)
-		items = append(items, emailObj)
+// Get_Attachment returns the base64 content of the attachment at index in
+// the message stored under key in folder.
+func (a *App) Get_Attachment(folder string, key string, index int) (string, error) {
+	if a.store == nil {
+		return "", errStoreNotOpen
+	}
+	content, err := a.store.RetrieveEmail(folder, key)
+	if err != nil {
+		return "", err
 	}
+	if content == "" {
+		return "", fmt.Errorf("no message %s in %s", key, folder)
+	}
+	email := parseStored(key, content)
+	if index < 0 || index >= len(email.Attachments) {
+		return "", fmt.Errorf("message %s has no attachment %d", key, index)
+	}
+	return email.Attachments[index].Content, nil
+}
 
+// searchText extracts what the search index holds for a message. One that
+// cannot be parsed is indexed under nothing and only found by filters.
+func searchText(eml string) storage.SearchText {
+	email, err := emailparser.ParseEmail(eml)
 	if err != nil {
-		return items
+		return storage.SearchText{}
 	}
 
-	return items
+	text := storage.SearchText{Subject: email.Subject, Body: email.Text}
+	if text.Body == "" {
+		text.Body = emailparser.HTMLToText(email.HTML)
+	}
+	if email.From != nil {
+		text.From = append(text.From, email.From.Name+" "+email.From.Address)
+	}
+	for _, list := range [][]*mail.Address{email.To, email.Cc, email.Bcc} {
+		for _, address := range list {
+			text.To = append(text.To, address.Name+" "+address.Address)
+		}
+	}
+	for _, attachment := range email.Attachments {
+		text.Attachments = append(text.Attachments, attachment.Filename)
+		if !attachment.Inline {
+			text.HasAttachment = true
+		}
+	}
+	return text
+}
+
+// parseListed parses a stored message to be listed. Attachments only carry
+// their name, type and size; Get_Attachment fetches the content when one is
+// opened.
+func parseListed(key, eml string) *emailparser.Email {
+	email := parseStored(key, eml)
+	attachments := make([]emailparser.Attachment, len(email.Attachments))
+	for i, attachment := range email.Attachments {
+		attachment.Content = ""
+		attachments[i] = attachment
+	}
+	email.Attachments = attachments
+	return email
+}
+
+// parseStored parses a stored message. One whose header cannot be read is
+// logged and shown with its raw text as the body, so it does not hide the
+// rest of the page.
+func parseStored(key, eml string) *emailparser.Email {
+	email, err := emailparser.ParseEmail(eml)
+	if err != nil {
+		fmt.Printf("Failed to parse message %s: %v\n", key, err)
+		return &emailparser.Email{Subject: "(unreadable message)", Text: eml, Size: len(eml)}
+	}
+	return email
+}
+
+// SearchPage is one page of search results, newest first.
+type SearchPage struct {
+	Items []MailItem `json:"items"`
+	// Next is the cursor to pass to Search for the following page, or "" on
+	// the last page.
+	Next  string `json:"next"`
+	Total int    `json:"total"`
+}
+
+// Search returns the page of messages matching query after cursor. The
+// query takes words and from:, to:, subject:, has:attachment, before:,
+// after:, in:, label: and is:unread operators.
+func (a *App) Search(query string, cursor string) (*SearchPage, error) {
+	if a.store == nil {
+		return nil, errStoreNotOpen
+	}
+	parsed, err := storage.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	results, err := a.store.Search(parsed, cursor, pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &SearchPage{Items: make([]MailItem, 0, len(results.Emails)), Next: results.Next, Total: results.Total}
+	for _, stored := range results.Emails {
+		item := newMailItem(stored)
+		page.Items = append(page.Items, item)
+	}
+	return page, nil
+}
+
+// Rebuild_Search_Index indexes all stored mail for search again.
+func (a *App) Rebuild_Search_Index() error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	return a.store.RebuildSearchIndex()
 }
 
 // func (a *App) Get_Inbox() []string {
@@ -157,27 +678,388 @@ func (a *App) Get_Items(folder string, page int) []string {
 // 	return inbox
 // }
 
-func (a *App) Get_Sent() []string {
-	emails, err := storage.RetrieveEmailsPaginated("sent", 1, 15)
-	var sent []string
-	for _, email := range emails {
-		emailObj, _ := emailparser.ParseEmail(email)
-		sent = append(sent, emailObj)
+// FolderCountsChanged is the payload of the FolderCountsChanged event.
+type FolderCountsChanged struct {
+	Folder string `json:"folder"`
+	storage.FolderCounts
+}
+
+// Set_Flags adds flags such as \Seen or \Flagged to the messages saved under
+// keys in folder. A FolderCountsChanged event carries the new counts.
+func (a *App) Set_Flags(folder string, keys []string, flags []string) error {
+	return a.setFlags(folder, keys, flags, true)
+}
+
+// Clear_Flags removes flags from the messages saved under keys in folder.
+func (a *App) Clear_Flags(folder string, keys []string, flags []string) error {
+	return a.setFlags(folder, keys, flags, false)
+}
+
+func (a *App) setFlags(folder string, keys []string, flags []string, set bool) error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	counts, err := a.store.SetFlags(folder, keys, flags, set)
+	if err != nil {
+		return err
+	}
+	runtime.EventsEmit(a.ctx, "FolderCountsChanged", FolderCountsChanged{Folder: folder, FolderCounts: counts})
+	return nil
+}
+
+// Get_Folder_Counts returns the total and unread counts of every folder.
+func (a *App) Get_Folder_Counts() (map[string]storage.FolderCounts, error) {
+	if a.store == nil {
+		return nil, errStoreNotOpen
+	}
+	return a.store.RetrieveAllFolderCounts()
+}
+
+// emitFolderCounts emits a FolderCountsChanged event with the current counts
+// of folder.
+func (a *App) emitFolderCounts(folder string) {
+	counts, err := a.store.RetrieveFolderCounts(folder)
+	if err != nil {
+		fmt.Println("Failed to read folder counts: ", err)
+		return
+	}
+	runtime.EventsEmit(a.ctx, "FolderCountsChanged", FolderCountsChanged{Folder: folder, FolderCounts: counts})
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// Get_Folders returns every folder with its counts, the system folders
+// first.
+func (a *App) Get_Folders() ([]storage.Folder, error) {
+	if a.store == nil {
+		return nil, errStoreNotOpen
+	}
+	return a.store.ListFolders()
+}
+
+// Create_Folder creates a folder. Nested folders are named after their
+// parent, as in "work/projects".
+func (a *App) Create_Folder(name string) error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	if err := a.store.CreateFolder(name); err != nil {
+		return err
+	}
+	runtime.EventsEmit(a.ctx, "FoldersChanged")
+	return nil
+}
+
+// Rename_Folder renames a folder, or moves it under another parent, with
+// its subfolders.
+func (a *App) Rename_Folder(name string, new_name string) error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	if err := a.store.RenameFolder(name, new_name); err != nil {
+		return err
+	}
+	runtime.EventsEmit(a.ctx, "FoldersChanged")
+	return nil
+}
+
+// Delete_Folder deletes a folder and its subfolders, moving their mail to
+// the trash.
+func (a *App) Delete_Folder(name string) error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	if err := a.store.DeleteFolder(name); err != nil {
+		return err
+	}
+	runtime.EventsEmit(a.ctx, "FoldersChanged")
+	a.emitFolderCounts(storage.FolderTrash)
+	return nil
+}
+
+// Move_Emails moves the messages saved under keys from one folder to
+// another.
+func (a *App) Move_Emails(from string, to string, keys []string) error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	if err := a.store.MoveEmails(from, to, keys); err != nil {
+		return err
+	}
+	a.emitFolderCounts(from)
+	a.emitFolderCounts(to)
+	return nil
+}
+
+// Copy_Emails copies the messages saved under keys to another folder.
+func (a *App) Copy_Emails(from string, to string, keys []string) error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	if err := a.store.CopyEmails(from, to, keys); err != nil {
+		return err
+	}
+	a.emitFolderCounts(to)
+	return nil
+}
+
+// Delete_Emails moves the messages saved under keys to the trash, or
+// deletes them for good if they are in the trash already.
+func (a *App) Delete_Emails(folder string, keys []string) error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	if err := a.store.DeleteEmails(folder, keys); err != nil {
+		return err
+	}
+	a.emitFolderCounts(folder)
+	a.emitFolderCounts(storage.FolderTrash)
+	return nil
+}
+
+// Empty_Trash deletes everything in the trash for good.
+func (a *App) Empty_Trash() error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	if _, err := a.store.ExpireTrash(0); err != nil {
+		return err
+	}
+	a.emitFolderCounts(storage.FolderTrash)
+	return nil
+}
+
+// Get_Labels returns every label with how many messages carry it.
+func (a *App) Get_Labels() ([]storage.Label, error) {
+	if a.store == nil {
+		return nil, errStoreNotOpen
+	}
+	return a.store.ListLabels()
+}
+
+// Create_Label creates a label.
+func (a *App) Create_Label(name string) error {
+	if a.store == nil {
+		return errStoreNotOpen
 	}
+	return a.labelsChanged(a.store.CreateLabel(name))
+}
 
+// Rename_Label renames a label on every message that carries it.
+func (a *App) Rename_Label(name string, new_name string) error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	return a.labelsChanged(a.store.RenameLabel(name, new_name))
+}
+
+// Delete_Label deletes a label. The messages that carried it stay where
+// they are.
+func (a *App) Delete_Label(name string) error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	return a.labelsChanged(a.store.DeleteLabel(name))
+}
+
+// Add_Labels adds labels to the messages saved under keys in folder,
+// creating the labels that do not exist yet.
+func (a *App) Add_Labels(folder string, keys []string, labels []string) error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	return a.labelsChanged(a.store.AddLabels(folder, keys, labels))
+}
+
+// Remove_Labels removes labels from the messages saved under keys in
+// folder.
+func (a *App) Remove_Labels(folder string, keys []string, labels []string) error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	return a.labelsChanged(a.store.RemoveLabels(folder, keys, labels))
+}
+
+func (a *App) labelsChanged(err error) error {
 	if err != nil {
-		return sent
+		return err
 	}
+	runtime.EventsEmit(a.ctx, "LabelsChanged")
+	return nil
+}
 
-	return sent
+// Get_Label returns the messages that carry a label, newest first, from
+// every folder.
+func (a *App) Get_Label(label string) ([]MailItem, error) {
+	if a.store == nil {
+		return nil, errStoreNotOpen
+	}
+	emails, err := a.store.RetrieveLabel(label)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]MailItem, 0, len(emails))
+	for _, stored := range emails {
+		item := newMailItem(stored)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Get_Sent returns the newest page of sent messages.
+func (a *App) Get_Sent() (*MailPage, error) {
+	return a.Get_Items("sent", "", false)
+}
+
+// Conversation is a thread with its parsed messages, oldest first.
+type Conversation struct {
+	ID       string                `json:"id"`
+	Subject  string                `json:"subject"`
+	Latest   time.Time             `json:"latest"`
+	Messages []ConversationMessage `json:"messages"`
 }
 
+// ConversationMessage is a stored message of a conversation. Parent is the
+// Message-ID of the message it replies to. As in a MailItem, Email carries
+// no attachment content; Get_Attachment fetches it by Folder and Key.
+type ConversationMessage struct {
+	Folder string             `json:"folder"`
+	Key    string             `json:"key"`
+	Parent string             `json:"parent,omitempty"`
+	Email  *emailparser.Email `json:"email"`
+}
+
+// Get_Threads returns the conversations across every folder but the trash,
+// most recently active first. The conversation index is built from the
+// stored mail the first time it is needed.
+func (a *App) Get_Threads() ([]Conversation, error) {
+	if a.store == nil {
+		return nil, errStoreNotOpen
+	}
+	threads, err := a.store.RetrieveThreads()
+	if err != nil {
+		return nil, err
+	}
+	if len(threads) == 0 {
+		if err := a.Rebuild_Threads(); err != nil {
+			return nil, err
+		}
+		if threads, err = a.store.RetrieveThreads(); err != nil {
+			return nil, err
+		}
+	}
+
+	conversations := make([]Conversation, 0, len(threads))
+	for _, thread := range threads {
+		conversation := Conversation{ID: thread.ID, Subject: thread.Subject, Latest: thread.Latest}
+		for _, entry := range thread.Messages {
+			content, err := a.store.RetrieveEmail(entry.Folder, entry.Key)
+			if err != nil {
+				return nil, err
+			}
+			if content == "" {
+				continue
+			}
+			conversation.Messages = append(conversation.Messages, ConversationMessage{
+				Folder: entry.Folder,
+				Key:    entry.Key,
+				Parent: entry.Parent,
+				Email:  parseListed(entry.Key, content),
+			})
+		}
+		if len(conversation.Messages) > 0 {
+			conversations = append(conversations, conversation)
+		}
+	}
+	return conversations, nil
+}
+
+// Rebuild_Threads rebuilds the conversation index from the mail stored in
+// every folder. Trashed mail is indexed so that it rejoins its conversation
+// if restored, but Get_Threads leaves it out.
+func (a *App) Rebuild_Threads() error {
+	if a.store == nil {
+		return errStoreNotOpen
+	}
+	folders, err := a.store.ListFolders()
+	if err != nil {
+		return err
+	}
+
+	var msgs []storage.ThreadMessage
+	for _, folder := range folders {
+		folder := folder.Name
+		err := a.store.ForEachEmail(folder, func(messageID, emlString string) error {
+			email, err := emailparser.ParseEmail(emlString)
+			if err != nil {
+				fmt.Printf("Skipping unreadable email %s: %v\n", messageID, err)
+				return nil
+			}
+			msgs = append(msgs, threadMessage(folder, messageID, email))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return a.store.RebuildThreads(msgs)
+}
+
+func threadMessage(folder, messageID string, email *emailparser.Email) storage.ThreadMessage {
+	smtpstack.FixLegacyMessageID(folder, messageID, email)
+	return storage.ThreadMessage{
+		Folder:     folder,
+		Key:        messageID,
+		MessageID:  email.MessageID,
+		InReplyTo:  email.InReplyTo,
+		References: email.References,
+		Subject:    email.Subject,
+		Date:       email.Date,
+	}
+}
+
+// Is_Setup reports whether setup has finished. When it has, the domain's DNS
+// records are checked in the background and a SetupDegraded event carrying
+// the failed checks is emitted if any of them no longer match.
 func (a *App) Is_Setup() bool {
 	status, _ := storage.ReadKeyFromFile("Config.Json", "Status")
 
-	if status == "Working" {
-		return true
-	} else {
+	if status != "Working" {
 		return false
 	}
+
+	go func() {
+		checks, err := a.Check_DNS()
+		if err != nil {
+			fmt.Println("DNS check failed: ", err)
+			return
+		}
+		if failed := smtpstack.FailedChecks(checks); len(failed) > 0 {
+			runtime.EventsEmit(a.ctx, "SetupDegraded", failed)
+		}
+	}()
+	return true
+}
+
+// Check_DNS resolves the configured domain's records and compares them with
+// what SES expects.
+func (a *App) Check_DNS() ([]smtpstack.RecordCheck, error) {
+	domain, err := storage.ReadKeyFromFile(storage.ConfigFile, "Domain")
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := smtpstack.ExpectedDNSRecords(domain)
+	if err != nil {
+		return nil, err
+	}
+	return smtpstack.CheckDNSRecords(a.ctx, nil, expected), nil
 }
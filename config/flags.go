@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// Message flags, named after their IMAP system flags.
+const (
+	FlagSeen     = `\Seen`
+	FlagFlagged  = `\Flagged`
+	FlagAnswered = `\Answered`
+	FlagDraft    = `\Draft`
+	FlagDeleted  = `\Deleted`
+)
+
+var knownFlags = map[string]bool{
+	FlagSeen:     true,
+	FlagFlagged:  true,
+	FlagAnswered: true,
+	FlagDraft:    true,
+	FlagDeleted:  true,
+}
+
+// SetFlags adds flags to, or with set false removes them from, the messages
+// saved under keys in folder, and returns the folder's updated counts. Keys
+// that are not in the folder are ignored.
+func (s *Store) SetFlags(folder string, keys, flags []string, set bool) (FolderCounts, error) {
+	for _, flag := range flags {
+		if !knownFlags[flag] {
+			return FolderCounts{}, fmt.Errorf("unknown flag %q", flag)
+		}
+	}
+
+	var counts FolderCounts
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		counts = readFolderCounts(tx, folder)
+		metas := nestedBucket(tx, messageMetaBucket, folder)
+		if metas == nil {
+			return nil
+		}
+
+		for _, key := range keys {
+			meta, err := getMeta(metas, []byte(key))
+			if err != nil {
+				return err
+			}
+			if meta == nil {
+				continue
+			}
+
+			wasSeen := meta.hasFlag(FlagSeen)
+			for _, flag := range flags {
+				if set {
+					meta.addFlag(flag)
+				} else {
+					meta.removeFlag(flag)
+				}
+			}
+			switch isSeen := meta.hasFlag(FlagSeen); {
+			case wasSeen && !isSeen:
+				counts.Unread++
+			case !wasSeen && isSeen:
+				counts.Unread--
+			}
+
+			if err := putJSON(metas, key, meta); err != nil {
+				return err
+			}
+		}
+		return writeFolderCounts(tx, folder, counts)
+	})
+	if err != nil {
+		return FolderCounts{}, fmt.Errorf("failed to set flags: %v", err)
+	}
+	return counts, nil
+}
+
+func (m *messageMeta) hasFlag(flag string) bool {
+	for _, existing := range m.Flags {
+		if existing == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *messageMeta) addFlag(flag string) {
+	if !m.hasFlag(flag) {
+		m.Flags = append(m.Flags, flag)
+		sort.Strings(m.Flags)
+	}
+}
+
+func (m *messageMeta) removeFlag(flag string) {
+	kept := m.Flags[:0]
+	for _, existing := range m.Flags {
+		if existing != flag {
+			kept = append(kept, existing)
+		}
+	}
+	m.Flags = kept
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetFlags(t *testing.T) {
+	store := openTestStore(t)
+	saveTestEmail(t, store, FolderInbox, "k1", time.Now())
+	saveTestEmail(t, store, FolderInbox, "k2", time.Now())
+
+	counts, err := store.SetFlags(FolderInbox, []string{"k1", "k2", "missing"}, []string{FlagSeen}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts != (FolderCounts{Total: 2}) {
+		t.Errorf("counts after marking read are %+v", counts)
+	}
+
+	// Setting a flag again does not count twice
+	if counts, _ := store.SetFlags(FolderInbox, []string{"k1"}, []string{FlagSeen}, true); counts.Unread != 0 {
+		t.Errorf("unread after marking read twice is %d", counts.Unread)
+	}
+	if counts, _ := store.SetFlags(FolderInbox, []string{"k1"}, []string{FlagSeen, FlagFlagged}, false); counts.Unread != 1 {
+		t.Errorf("unread after marking unread is %d", counts.Unread)
+	}
+	assertCounts(t, store, FolderInbox, FolderCounts{Total: 2, Unread: 1})
+
+	if _, err := store.SetFlags(FolderInbox, []string{"k1"}, []string{`\Important`}, true); err == nil {
+		t.Error("an unknown flag was not rejected")
+	}
+}
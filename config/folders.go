@@ -0,0 +1,531 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// System folders. They always exist and cannot be renamed or deleted.
+const (
+	FolderInbox = "inbox"
+	FolderSent  = "sent"
+	FolderTrash = "trash"
+)
+
+// FolderSeparator separates the levels of a nested folder name, as in
+// "work/projects".
+const FolderSeparator = "/"
+
+// foldersBucket maps the name of every folder to its folderRecord.
+const foldersBucket = "folders"
+
+var systemFolders = []string{FolderInbox, FolderSent, FolderTrash}
+
+// ErrFolderExists is returned when creating or renaming to a folder that
+// already exists.
+var ErrFolderExists = errors.New("folder already exists")
+
+// Folder is a mail folder with its counts.
+type Folder struct {
+	// Name is the full name, including the names of its parents.
+	Name   string `json:"name"`
+	Parent string `json:"parent,omitempty"`
+	System bool   `json:"system"`
+	FolderCounts
+}
+
+type folderRecord struct {
+	Created time.Time `json:"created"`
+}
+
+// ListFolders returns every folder, parents before their children.
+func (s *Store) ListFolders() ([]Folder, error) {
+	var folders []Folder
+	err := s.db.View(func(tx *bolt.Tx) error {
+		registry := tx.Bucket([]byte(foldersBucket))
+		if registry == nil {
+			return nil
+		}
+		return registry.ForEach(func(k, v []byte) error {
+			name := string(k)
+			folders = append(folders, Folder{
+				Name:         name,
+				Parent:       parentFolder(name),
+				System:       isSystemFolder(name),
+				FolderCounts: readFolderCounts(tx, name),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list folders: %v", err)
+	}
+
+	sort.SliceStable(folders, func(i, j int) bool {
+		return folderOrder(folders[i].Name) < folderOrder(folders[j].Name)
+	})
+	return folders, nil
+}
+
+// CreateFolder creates a folder. A nested folder's parent must exist.
+func (s *Store) CreateFolder(name string) error {
+	if err := validateFolderName(name); err != nil {
+		return err
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if folderExists(tx, name) {
+			return ErrFolderExists
+		}
+		if parent := parentFolder(name); parent != "" && !folderExists(tx, parent) {
+			return fmt.Errorf("parent folder %q does not exist", parent)
+		}
+		return registerFolder(tx, name)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create folder %s: %w", name, err)
+	}
+	return nil
+}
+
+// RenameFolder renames a folder, or moves it under another parent, along
+// with its subfolders and messages.
+func (s *Store) RenameFolder(name, newName string) error {
+	if isSystemFolder(name) {
+		return fmt.Errorf("the %s folder cannot be renamed", name)
+	}
+	if err := validateFolderName(newName); err != nil {
+		return err
+	}
+	if newName == name || strings.HasPrefix(newName, name+FolderSeparator) {
+		return fmt.Errorf("cannot move folder %s into itself", name)
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if !folderExists(tx, name) {
+			return fmt.Errorf("folder %q does not exist", name)
+		}
+		if folderExists(tx, newName) {
+			return ErrFolderExists
+		}
+		if parent := parentFolder(newName); parent != "" && !folderExists(tx, parent) {
+			return fmt.Errorf("parent folder %q does not exist", parent)
+		}
+
+		for _, folder := range subtree(tx, name) {
+			renamed := newName + strings.TrimPrefix(folder, name)
+			if err := registerFolder(tx, renamed); err != nil {
+				return err
+			}
+			if err := moveAll(tx, folder, renamed); err != nil {
+				return err
+			}
+			if err := dropFolder(tx, folder); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rename folder %s: %w", name, err)
+	}
+	return nil
+}
+
+// DeleteFolder deletes a folder and its subfolders. Their messages are moved
+// to the trash.
+func (s *Store) DeleteFolder(name string) error {
+	if isSystemFolder(name) {
+		return fmt.Errorf("the %s folder cannot be deleted", name)
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if !folderExists(tx, name) {
+			return fmt.Errorf("folder %q does not exist", name)
+		}
+		for _, folder := range subtree(tx, name) {
+			if err := moveAll(tx, folder, FolderTrash); err != nil {
+				return err
+			}
+			if err := dropFolder(tx, folder); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete folder %s: %w", name, err)
+	}
+	return nil
+}
+
+// MoveEmails moves the messages saved under keys from one folder to another.
+// Moving to the trash records when and where from the messages were deleted.
+func (s *Store) MoveEmails(from, to string, keys []string) error {
+	return s.transfer(from, to, keys, false)
+}
+
+// CopyEmails copies the messages saved under keys to another folder, with
+// their flags and labels.
+func (s *Store) CopyEmails(from, to string, keys []string) error {
+	return s.transfer(from, to, keys, true)
+}
+
+// DeleteEmails moves the messages saved under keys to the trash, or deletes
+// them for good if they are already in it.
+func (s *Store) DeleteEmails(folder string, keys []string) error {
+	if folder != FolderTrash {
+		return s.MoveEmails(folder, FolderTrash, keys)
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		moved := map[location]location{}
+		for _, key := range keys {
+			if err := removeEmail(tx, folder, []byte(key)); err != nil {
+				return err
+			}
+			moved[location{folder, key}] = location{}
+		}
+		return relocateThreadEntries(tx, moved)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete emails: %v", err)
+	}
+	return nil
+}
+
+// ExpireTrash deletes the messages that have been in the trash longer than
+// maxAge and returns how many it deleted.
+func (s *Store) ExpireTrash(maxAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-maxAge)
+	expired := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		metas := nestedBucket(tx, messageMetaBucket, FolderTrash)
+		if metas == nil {
+			return nil
+		}
+
+		var keys []string
+		err := metas.ForEach(func(k, v []byte) error {
+			meta, err := getMeta(metas, k)
+			if err != nil {
+				return err
+			}
+			// Messages from before trash times were kept expire now
+			if meta.Trashed == nil || meta.Trashed.Before(cutoff) {
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		moved := map[location]location{}
+		for _, key := range keys {
+			if err := removeEmail(tx, FolderTrash, []byte(key)); err != nil {
+				return err
+			}
+			moved[location{FolderTrash, key}] = location{}
+		}
+		expired = len(keys)
+		return relocateThreadEntries(tx, moved)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to empty trash: %v", err)
+	}
+	return expired, nil
+}
+
+func (s *Store) transfer(from, to string, keys []string, keep bool) error {
+	if from == to {
+		return fmt.Errorf("messages are already in %s", to)
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if !folderExists(tx, to) {
+			return fmt.Errorf("folder %q does not exist", to)
+		}
+		moved := map[location]location{}
+		for _, key := range keys {
+			ok, err := transferEmail(tx, from, to, []byte(key), keep)
+			if err != nil {
+				return err
+			}
+			if ok && !keep {
+				moved[location{from, key}] = location{to, key}
+			}
+		}
+		return relocateThreadEntries(tx, moved)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move emails: %w", err)
+	}
+	return nil
+}
+
+// moveAll moves every message of folder into to.
+func moveAll(tx *bolt.Tx, folder, to string) error {
+	bucket := tx.Bucket([]byte(folder))
+	if bucket == nil {
+		return nil
+	}
+
+	var keys [][]byte
+	bucket.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	})
+
+	moved := map[location]location{}
+	for _, key := range keys {
+		ok, err := transferEmail(tx, folder, to, key, false)
+		if err != nil {
+			return err
+		}
+		if ok {
+			moved[location{folder, string(key)}] = location{to, string(key)}
+		}
+	}
+	return relocateThreadEntries(tx, moved)
+}
+
+// transferEmail moves or copies one message between folders and reports
+// whether the message was found.
+func transferEmail(tx *bolt.Tx, from, to string, key []byte, keep bool) (bool, error) {
+	source := tx.Bucket([]byte(from))
+	if source == nil {
+		return false, nil
+	}
+	eml := source.Get(key)
+	if eml == nil {
+		return false, nil
+	}
+	eml = append([]byte{}, eml...)
+
+	target, err := tx.CreateBucketIfNotExists([]byte(to))
+	if err != nil {
+		return false, err
+	}
+	if target.Get(key) != nil {
+		if to != FolderTrash {
+			return false, fmt.Errorf("message ID %s: %w", key, ErrEmailExists)
+		}
+		// Every folder shares the trash, so a copy deleted from another folder
+		// may be there already. It is the same message; the newer one replaces it
+		if err := removeEmail(tx, FolderTrash, key); err != nil {
+			return false, err
+		}
+	}
+
+	meta, err := getMeta(nestedBucket(tx, messageMetaBucket, from), key)
+	if err != nil {
+		return false, err
+	}
+	// Keep the search terms rather than parsing the message again. One that
+	// is not indexed yet is left for backfillSearch
+	doc, err := getSearchDoc(tx, from, key)
+	if err != nil {
+		return false, err
+	}
+	if !keep {
+		if _, err := removeMeta(tx, from, key); err != nil {
+			return false, err
+		}
+		if err := source.Delete(key); err != nil {
+			return false, err
+		}
+	}
+	if meta == nil {
+		meta = &messageMeta{Received: ReceivedTime(string(eml))}
+	}
+
+	meta.Trashed, meta.Origin = nil, ""
+	if to == FolderTrash {
+		now := time.Now()
+		meta.Trashed, meta.Origin = &now, from
+	}
+
+	if err := target.Put(key, eml); err != nil {
+		return false, err
+	}
+	if err := addMeta(tx, to, key, meta); err != nil {
+		return false, err
+	}
+	if doc == nil {
+		return true, nil
+	}
+	return true, indexSearchDoc(tx, to, key, doc)
+}
+
+// removeEmail deletes a message and its index entries.
+func removeEmail(tx *bolt.Tx, folder string, key []byte) error {
+	bucket := tx.Bucket([]byte(folder))
+	if bucket == nil {
+		return nil
+	}
+	if _, err := removeMeta(tx, folder, key); err != nil {
+		return err
+	}
+	return bucket.Delete(key)
+}
+
+// location is where a message is saved. The zero location means deleted.
+type location struct {
+	folder, key string
+}
+
+// relocateThreadEntries points the conversation index at the new locations of
+// moved messages.
+func relocateThreadEntries(tx *bolt.Tx, moved map[location]location) error {
+	containers := tx.Bucket([]byte(threadContainersBucket))
+	if containers == nil || len(moved) == 0 {
+		return nil
+	}
+
+	updates := map[string]*threadContainer{}
+	err := containers.ForEach(func(k, v []byte) error {
+		container, err := getContainer(containers, string(k))
+		if err != nil || container == nil || container.Folder == "" {
+			return err
+		}
+		if to, ok := moved[location{container.Folder, container.Key}]; ok {
+			container.Folder, container.Key = to.folder, to.key
+			updates[string(k)] = container
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for id, container := range updates {
+		if err := putContainer(containers, id, container); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerFolders adds the system folders and any folder saved before the
+// registry existed to the registry.
+func registerFolders(tx *bolt.Tx) error {
+	names := append([]string{}, systemFolders...)
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if !internalBuckets[string(name)] {
+			names = append(names, string(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if !folderExists(tx, name) {
+			if err := registerFolder(tx, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func registerFolder(tx *bolt.Tx, name string) error {
+	registry, err := tx.CreateBucketIfNotExists([]byte(foldersBucket))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+		return err
+	}
+	return putJSON(registry, name, folderRecord{Created: time.Now()})
+}
+
+// dropFolder deletes an emptied folder and its indexes.
+func dropFolder(tx *bolt.Tx, name string) error {
+	for _, parent := range []string{messageMetaBucket, receivedIndexBucket} {
+		if bucket := tx.Bucket([]byte(parent)); bucket != nil {
+			if err := bucket.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+	}
+	if counts := tx.Bucket([]byte(folderCountsBucket)); counts != nil {
+		if err := counts.Delete([]byte(name)); err != nil {
+			return err
+		}
+	}
+	if err := tx.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return tx.Bucket([]byte(foldersBucket)).Delete([]byte(name))
+}
+
+func folderExists(tx *bolt.Tx, name string) bool {
+	registry := tx.Bucket([]byte(foldersBucket))
+	return registry != nil && registry.Get([]byte(name)) != nil
+}
+
+// subtree returns name and the names of all folders nested in it, deepest
+// first.
+func subtree(tx *bolt.Tx, name string) []string {
+	folders := []string{name}
+	c := tx.Bucket([]byte(foldersBucket)).Cursor()
+	prefix := []byte(name + FolderSeparator)
+	for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = c.Next() {
+		folders = append(folders, string(k))
+	}
+	sort.SliceStable(folders, func(i, j int) bool {
+		return strings.Count(folders[i], FolderSeparator) > strings.Count(folders[j], FolderSeparator)
+	})
+	return folders
+}
+
+func validateFolderName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("folder name is empty")
+	}
+	for _, level := range strings.Split(name, FolderSeparator) {
+		if strings.TrimSpace(level) == "" {
+			return fmt.Errorf("folder name %q has an empty level", name)
+		}
+	}
+	if internalBuckets[name] || isSystemFolder(name) {
+		return fmt.Errorf("folder name %q is reserved", name)
+	}
+	return nil
+}
+
+func parentFolder(name string) string {
+	if i := strings.LastIndex(name, FolderSeparator); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+func isSystemFolder(name string) bool {
+	for _, system := range systemFolders {
+		if name == system {
+			return true
+		}
+	}
+	return false
+}
+
+// folderOrder sorts the system folders first, then the user's folders by
+// name so parents come before their children.
+func folderOrder(name string) string {
+	for i, system := range systemFolders {
+		if name == system {
+			return fmt.Sprintf("\x00%d", i)
+		}
+	}
+	return name
+}
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDeleteCopiedEmail deletes a copied message from both folders. The
+// trash is shared, so the second delete finds the first copy there.
+func TestDeleteCopiedEmail(t *testing.T) {
+	store := openTestStore(t)
+	saveTestEmail(t, store, FolderInbox, "k1", time.Now())
+	if err := store.CreateFolder("work"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CopyEmails(FolderInbox, "work", []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteEmails(FolderInbox, []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteEmails("work", []string{"k1"}); err != nil {
+		t.Fatalf("DeleteEmails(work): %v", err)
+	}
+	assertKeys(t, store, "work")
+	assertKeys(t, store, FolderTrash, "k1")
+	assertCounts(t, store, FolderTrash, FolderCounts{Total: 1, Unread: 1})
+
+	// Deleting the folder trashes its messages the same way
+	saveTestEmail(t, store, FolderInbox, "k2", time.Now())
+	if err := store.CopyEmails(FolderInbox, "work", []string{"k2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteEmails(FolderInbox, []string{"k2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteFolder("work"); err != nil {
+		t.Fatalf("DeleteFolder(work): %v", err)
+	}
+	assertKeys(t, store, FolderTrash, "k2", "k1")
+	assertCounts(t, store, FolderTrash, FolderCounts{Total: 2, Unread: 2})
+}
+
+func TestFolders(t *testing.T) {
+	store := openTestStore(t)
+	for _, name := range []string{"work", "work/projects", "work/projects/2024"} {
+		if err := store.CreateFolder(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveTestEmail(t, store, "work/projects", "k1", time.Now())
+
+	rejected := []struct {
+		name string
+		err  error
+	}{
+		{"create existing", store.CreateFolder("work")},
+		{"create without parent", store.CreateFolder("home/bills")},
+		{"create empty level", store.CreateFolder("work//x")},
+		{"create system", store.CreateFolder(FolderTrash)},
+		{"create internal", store.CreateFolder(foldersBucket)},
+		{"rename system", store.RenameFolder(FolderInbox, "mail")},
+		{"rename missing", store.RenameFolder("home", "house")},
+		{"rename to existing", store.RenameFolder("work/projects", "work")},
+		{"rename into itself", store.RenameFolder("work", "work/projects/work")},
+		{"rename without parent", store.RenameFolder("work", "home/work")},
+		{"delete system", store.DeleteFolder(FolderSent)},
+		{"delete missing", store.DeleteFolder("home")},
+	}
+	for _, r := range rejected {
+		if r.err == nil {
+			t.Errorf("%s was not rejected", r.name)
+		}
+	}
+	if err := store.CreateFolder("work"); !errors.Is(err, ErrFolderExists) {
+		t.Errorf("creating an existing folder returned %v, want ErrFolderExists", err)
+	}
+
+	// Renaming carries the subfolders and their messages along
+	if err := store.RenameFolder("work", "office"); err != nil {
+		t.Fatal(err)
+	}
+	assertFolders(t, store, "inbox", "sent", "trash", "office", "office/projects", "office/projects/2024")
+	assertKeys(t, store, "office/projects", "k1")
+	assertCounts(t, store, "office/projects", FolderCounts{Total: 1, Unread: 1})
+	assertCounts(t, store, "work/projects", FolderCounts{})
+
+	// Deleting trashes the messages of the whole subtree
+	if err := store.DeleteFolder("office"); err != nil {
+		t.Fatal(err)
+	}
+	assertFolders(t, store, "inbox", "sent", "trash")
+	assertKeys(t, store, FolderTrash, "k1")
+}
+
+func TestMoveEmails(t *testing.T) {
+	store := openTestStore(t)
+	now := time.Now()
+	saveTestEmail(t, store, FolderInbox, "k1", now.Add(-2*time.Hour))
+	saveTestEmail(t, store, FolderInbox, "k2", now.Add(-time.Hour))
+	saveTestEmail(t, store, FolderInbox, "k3", now)
+	if err := store.CreateFolder("work"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SetFlags(FolderInbox, []string{"k1"}, []string{FlagSeen, FlagFlagged}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddLabels(FolderInbox, []string{"k1"}, []string{"urgent"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys that are not in the folder are skipped
+	if err := store.MoveEmails(FolderInbox, "work", []string{"k1", "k2", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	assertKeys(t, store, FolderInbox, "k3")
+	assertKeys(t, store, "work", "k2", "k1")
+	assertCounts(t, store, FolderInbox, FolderCounts{Total: 1, Unread: 1})
+	assertCounts(t, store, "work", FolderCounts{Total: 2, Unread: 1})
+
+	// Flags and labels travel with the message
+	page, err := store.RetrievePage("work", "", 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := page.Emails[0]
+	if moved.Key != "k1" || len(moved.Flags) != 2 || len(moved.Labels) != 1 {
+		t.Errorf("moved message is %+v", moved)
+	}
+	labeled, err := store.RetrieveLabel("urgent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labeled) != 1 || labeled[0].Folder != "work" {
+		t.Errorf("label urgent holds %+v", labeled)
+	}
+
+	if err := store.CopyEmails("work", FolderInbox, []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+	assertKeys(t, store, FolderInbox, "k3", "k1")
+	assertKeys(t, store, "work", "k2", "k1")
+
+	if err := store.MoveEmails("work", FolderInbox, []string{"k2", "k1"}); !errors.Is(err, ErrEmailExists) {
+		t.Errorf("moving onto an existing key returned %v, want ErrEmailExists", err)
+	}
+	// The failed move is rolled back as a whole
+	assertKeys(t, store, "work", "k2", "k1")
+	assertKeys(t, store, FolderInbox, "k3", "k1")
+
+	if err := store.MoveEmails("work", "work", []string{"k2"}); err == nil {
+		t.Error("moving into the same folder was not rejected")
+	}
+	if err := store.MoveEmails("work", "home", []string{"k2"}); err == nil {
+		t.Error("moving into a missing folder was not rejected")
+	}
+}
+
+func TestDeleteEmails(t *testing.T) {
+	store := openTestStore(t)
+	saveTestEmail(t, store, FolderInbox, "k1", time.Now())
+	saveTestEmail(t, store, FolderInbox, "k2", time.Now())
+
+	if err := store.DeleteEmails(FolderInbox, []string{"k1", "k2"}); err != nil {
+		t.Fatal(err)
+	}
+	assertKeys(t, store, FolderInbox)
+	assertCounts(t, store, FolderInbox, FolderCounts{})
+	assertCounts(t, store, FolderTrash, FolderCounts{Total: 2, Unread: 2})
+
+	// Moving out of the trash forgets when the message was deleted
+	if err := store.MoveEmails(FolderTrash, FolderInbox, []string{"k2"}); err != nil {
+		t.Fatal(err)
+	}
+	if expired, err := store.ExpireTrash(time.Hour); err != nil || expired != 0 {
+		t.Errorf("ExpireTrash(1h) = %d, %v", expired, err)
+	}
+	if expired, err := store.ExpireTrash(-time.Hour); err != nil || expired != 1 {
+		t.Errorf("ExpireTrash(-1h) = %d, %v", expired, err)
+	}
+	assertKeys(t, store, FolderTrash)
+	assertKeys(t, store, FolderInbox, "k2")
+
+	// Deleting from the trash deletes for good
+	if err := store.DeleteEmails(FolderInbox, []string{"k2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteEmails(FolderTrash, []string{"k2"}); err != nil {
+		t.Fatal(err)
+	}
+	assertKeys(t, store, FolderTrash)
+	assertCounts(t, store, FolderTrash, FolderCounts{})
+	if eml, _ := store.RetrieveEmail(FolderTrash, "k2"); eml != "" {
+		t.Error("deleted message is still saved")
+	}
+}
+
+// assertKeys checks the keys saved in folder, newest first.
+func assertKeys(t *testing.T, store *Store, folder string, want ...string) {
+	t.Helper()
+	if got := folderKeys(t, store, folder); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("%s holds %v, want %v", folder, got, want)
+	}
+}
+
+func assertCounts(t *testing.T, store *Store, folder string, want FolderCounts) {
+	t.Helper()
+	got, err := store.RetrieveFolderCounts(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("%s counts are %+v, want %+v", folder, got, want)
+	}
+}
+
+func assertFolders(t *testing.T, store *Store, want ...string) {
+	t.Helper()
+	folders, err := store.ListFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, folder := range folders {
+		got = append(got, folder.Name)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("folders are %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,384 @@
+package config
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Buckets of the per-folder message index. Each holds one nested bucket per
+// folder.
+const (
+	// messageMetaBucket maps a message key to its messageMeta.
+	messageMetaBucket = "message_meta"
+	// receivedIndexBucket has a key per message ordered by received time:
+	// the time as big endian Unix nanoseconds followed by the message key.
+	receivedIndexBucket = "received_index"
+	// folderCountsBucket maps a folder to its FolderCounts.
+	folderCountsBucket = "folder_counts"
+)
+
+// internalBuckets are the top level buckets that are not folders.
+var internalBuckets = map[string]bool{
+	messageMetaBucket:      true,
+	receivedIndexBucket:    true,
+	folderCountsBucket:     true,
+	foldersBucket:          true,
+	labelsBucket:           true,
+	labelIndexBucket:       true,
+	searchIndexBucket:      true,
+	searchDocsBucket:       true,
+	syncStateBucket:        true,
+	threadContainersBucket: true,
+	threadsBucket:          true,
+	threadSubjectsBucket:   true,
+}
+
+// messageMeta is what the store keeps about a message besides its EML.
+type messageMeta struct {
+	Received time.Time `json:"received"`
+	Flags    []string  `json:"flags,omitempty"`
+	Labels   []string  `json:"labels,omitempty"`
+	// Trashed and Origin are set on messages in the trash: when they were
+	// deleted and the folder they were deleted from.
+	Trashed *time.Time `json:"trashed,omitempty"`
+	Origin  string     `json:"origin,omitempty"`
+}
+
+// FolderCounts are the number of messages in a folder and how many of them
+// are unread.
+type FolderCounts struct {
+	Total  int `json:"total"`
+	Unread int `json:"unread"`
+}
+
+// StoredEmail is a message as saved in a folder.
+type StoredEmail struct {
+	// Folder is not set on the messages of a Page, which are all in one.
+	Folder   string
+	Key      string
+	EML      string
+	Received time.Time
+	Flags    []string
+	Labels   []string
+}
+
+// Page is one page of a folder in received order.
+type Page struct {
+	Emails []StoredEmail
+	// Next is the cursor of the following page, or "" if this is the last.
+	Next string
+	FolderCounts
+}
+
+// RetrievePage returns up to limit messages of the folder after cursor,
+// newest first unless oldestFirst is set. An empty cursor starts at the
+// newest or oldest message. The page carries the folder's counts.
+func (s *Store) RetrievePage(folder, cursor string, limit int, oldestFirst bool) (*Page, error) {
+	after, err := hex.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q", cursor)
+	}
+
+	page := &Page{}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		page.FolderCounts = readFolderCounts(tx, folder)
+
+		index := nestedBucket(tx, receivedIndexBucket, folder)
+		emails := tx.Bucket([]byte(folder))
+		if index == nil || emails == nil {
+			return nil
+		}
+		metas := nestedBucket(tx, messageMetaBucket, folder)
+
+		c := index.Cursor()
+		var k []byte
+		switch {
+		case len(after) == 0 && oldestFirst:
+			k, _ = c.First()
+		case len(after) == 0:
+			k, _ = c.Last()
+		case oldestFirst:
+			if k, _ = c.Seek(after); k != nil && string(k) == string(after) {
+				k, _ = c.Next()
+			}
+		default:
+			// Seek lands on the first key at or after the cursor; step back past it
+			if k, _ = c.Seek(after); k == nil {
+				k, _ = c.Last()
+			}
+			if k != nil && string(k) >= string(after) {
+				k, _ = c.Prev()
+			}
+		}
+
+		for ; k != nil && len(page.Emails) < limit; k = step(c, oldestFirst) {
+			key := k[8:]
+			email := StoredEmail{Key: string(key), EML: string(emails.Get(key))}
+			if meta, err := getMeta(metas, key); err == nil && meta != nil {
+				email.Received = meta.Received
+				email.Flags = meta.Flags
+				email.Labels = meta.Labels
+			}
+			page.Emails = append(page.Emails, email)
+			page.Next = hex.EncodeToString(k)
+		}
+		if k == nil {
+			page.Next = ""
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve emails: %v", err)
+	}
+	return page, nil
+}
+
+// RetrieveFolderCounts returns the message counts of a folder.
+func (s *Store) RetrieveFolderCounts(folder string) (FolderCounts, error) {
+	var counts FolderCounts
+	err := s.db.View(func(tx *bolt.Tx) error {
+		counts = readFolderCounts(tx, folder)
+		return nil
+	})
+	return counts, err
+}
+
+// RetrieveAllFolderCounts returns the message counts of every folder.
+func (s *Store) RetrieveAllFolderCounts() (map[string]FolderCounts, error) {
+	counts := map[string]FolderCounts{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !internalBuckets[string(name)] {
+				counts[string(name)] = readFolderCounts(tx, string(name))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve folder counts: %v", err)
+	}
+	return counts, nil
+}
+
+func step(c *bolt.Cursor, forward bool) []byte {
+	var k []byte
+	if forward {
+		k, _ = c.Next()
+	} else {
+		k, _ = c.Prev()
+	}
+	return k
+}
+
+// indexEmail adds a newly saved message to the folder's index and counts,
+// and to the search index under doc if it is not nil. Mail in the sent
+// folder starts out read.
+func indexEmail(tx *bolt.Tx, folder string, key []byte, eml string, doc *searchDoc) error {
+	meta := &messageMeta{Received: ReceivedTime(eml)}
+	if folder == FolderSent {
+		meta.Flags = []string{FlagSeen}
+	}
+	if err := addMeta(tx, folder, key, meta); err != nil {
+		return err
+	}
+	if doc == nil {
+		return nil
+	}
+	return indexSearchDoc(tx, folder, key, doc)
+}
+
+// addMeta records meta for the message saved under key in folder and adds
+// the message to the folder's received index, counts and labels.
+func addMeta(tx *bolt.Tx, folder string, key []byte, meta *messageMeta) error {
+	if err := putMeta(tx, folder, key, meta); err != nil {
+		return err
+	}
+
+	index, err := createNestedBucket(tx, receivedIndexBucket, folder)
+	if err != nil {
+		return err
+	}
+	if err := index.Put(receivedIndexKey(meta.Received, key), nil); err != nil {
+		return err
+	}
+
+	if err := labelMessage(tx, folder, key, meta.Labels); err != nil {
+		return err
+	}
+	return adjustFolderCounts(tx, folder, meta, 1)
+}
+
+// removeMeta undoes addMeta for the message saved under key in folder, takes
+// it out of the search index and returns its meta, or nil if the message is
+// not indexed.
+func removeMeta(tx *bolt.Tx, folder string, key []byte) (*messageMeta, error) {
+	if err := unindexSearchDoc(tx, folder, key); err != nil {
+		return nil, err
+	}
+
+	metas := nestedBucket(tx, messageMetaBucket, folder)
+	meta, err := getMeta(metas, key)
+	if err != nil || meta == nil {
+		return nil, err
+	}
+	if err := metas.Delete(key); err != nil {
+		return nil, err
+	}
+
+	if index := nestedBucket(tx, receivedIndexBucket, folder); index != nil {
+		if err := index.Delete(receivedIndexKey(meta.Received, key)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := unlabelMessage(tx, folder, key, meta.Labels); err != nil {
+		return nil, err
+	}
+	return meta, adjustFolderCounts(tx, folder, meta, -1)
+}
+
+// adjustFolderCounts adds delta messages like meta to the folder's counts.
+func adjustFolderCounts(tx *bolt.Tx, folder string, meta *messageMeta, delta int) error {
+	counts := readFolderCounts(tx, folder)
+	counts.Total += delta
+	if !meta.hasFlag(FlagSeen) {
+		counts.Unread += delta
+	}
+	return writeFolderCounts(tx, folder, counts)
+}
+
+// backfillIndex indexes the messages of every folder saved before the index
+// existed. Store.backfillSearch adds them to the search index.
+func backfillIndex(tx *bolt.Tx) error {
+	var folders []string
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if !internalBuckets[string(name)] {
+			folders = append(folders, string(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, folder := range folders {
+		metas := nestedBucket(tx, messageMetaBucket, folder)
+		var missing [][]byte
+		err := tx.Bucket([]byte(folder)).ForEach(func(k, v []byte) error {
+			if metas == nil || metas.Get(k) == nil {
+				missing = append(missing, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range missing {
+			eml := tx.Bucket([]byte(folder)).Get(key)
+			if err := indexEmail(tx, folder, key, string(eml), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReceivedTime returns when a message was received: the date of its newest
+// Received header, or its Date header for mail that has none, such as sent
+// mail. It is the current time if neither can be read.
+func ReceivedTime(eml string) time.Time {
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(eml))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return time.Now()
+	}
+
+	if received := header.Get("Received"); received != "" {
+		if i := strings.LastIndex(received, ";"); i >= 0 {
+			if date, err := mail.ParseDate(strings.TrimSpace(received[i+1:])); err == nil {
+				return date
+			}
+		}
+	}
+	if date, err := mail.ParseDate(header.Get("Date")); err == nil {
+		return date
+	}
+	return time.Now()
+}
+
+func receivedIndexKey(received time.Time, key []byte) []byte {
+	nanos := received.UnixNano()
+	if nanos < 0 {
+		nanos = 0
+	}
+	indexKey := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(indexKey, uint64(nanos))
+	return append(indexKey, key...)
+}
+
+func readFolderCounts(tx *bolt.Tx, folder string) FolderCounts {
+	var counts FolderCounts
+	if bucket := tx.Bucket([]byte(folderCountsBucket)); bucket != nil {
+		if value := bucket.Get([]byte(folder)); value != nil {
+			json.Unmarshal(value, &counts)
+		}
+	}
+	return counts
+}
+
+func writeFolderCounts(tx *bolt.Tx, folder string, counts FolderCounts) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(folderCountsBucket))
+	if err != nil {
+		return err
+	}
+	return putJSON(bucket, folder, counts)
+}
+
+func getMeta(metas *bolt.Bucket, key []byte) (*messageMeta, error) {
+	if metas == nil {
+		return nil, nil
+	}
+	value := metas.Get(key)
+	if value == nil {
+		return nil, nil
+	}
+	var meta messageMeta
+	if err := json.Unmarshal(value, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func putMeta(tx *bolt.Tx, folder string, key []byte, meta *messageMeta) error {
+	metas, err := createNestedBucket(tx, messageMetaBucket, folder)
+	if err != nil {
+		return err
+	}
+	return putJSON(metas, string(key), meta)
+}
+
+// nestedBucket returns the bucket name inside the top level bucket parent,
+// or nil if either does not exist.
+func nestedBucket(tx *bolt.Tx, parent, name string) *bolt.Bucket {
+	bucket := tx.Bucket([]byte(parent))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Bucket([]byte(name))
+}
+
+func createNestedBucket(tx *bolt.Tx, parent, name string) (*bolt.Bucket, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(parent))
+	if err != nil {
+		return nil, err
+	}
+	return bucket.CreateBucketIfNotExists([]byte(name))
+}
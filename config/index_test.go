@@ -0,0 +1,90 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetrievePage(t *testing.T) {
+	store := openTestStore(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		saveTestEmail(t, store, FolderInbox, key, start.Add(time.Duration(i)*time.Hour))
+	}
+	// Two messages received at the same time are both paged through
+	saveTestEmail(t, store, FolderInbox, "k0", start)
+
+	for _, tt := range []struct {
+		oldestFirst bool
+		want        []string
+	}{
+		{false, []string{"k5,k4", "k3,k2", "k1,k0"}},
+		{true, []string{"k0,k1", "k2,k3", "k4,k5"}},
+	} {
+		cursor := ""
+		for i, want := range tt.want {
+			page, err := store.RetrievePage(FolderInbox, cursor, 2, tt.oldestFirst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, email := range page.Emails {
+				keys = append(keys, email.Key)
+			}
+			if got := strings.Join(keys, ","); got != want {
+				t.Errorf("oldestFirst=%v page %d holds %s, want %s", tt.oldestFirst, i, got, want)
+			}
+			if last := i == len(tt.want)-1; last != (page.Next == "") {
+				t.Errorf("oldestFirst=%v page %d has next cursor %q", tt.oldestFirst, i, page.Next)
+			}
+			if page.Total != 6 || page.Unread != 6 {
+				t.Errorf("page counts are %+v", page.FolderCounts)
+			}
+			cursor = page.Next
+		}
+	}
+
+	page, err := store.RetrievePage(FolderInbox, "", 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email := page.Emails[0]; !email.Received.Equal(start.Add(4*time.Hour)) || !strings.Contains(email.EML, "Message k5") {
+		t.Errorf("newest message is %+v", email)
+	}
+
+	if _, err := store.RetrievePage(FolderInbox, "not hex", 2, false); err == nil {
+		t.Error("an invalid cursor was not rejected")
+	}
+	if page, err := store.RetrievePage("missing", "", 2, false); err != nil || len(page.Emails) != 0 {
+		t.Errorf("RetrievePage of a missing folder = %+v, %v", page, err)
+	}
+}
+
+func TestFolderCounts(t *testing.T) {
+	store := openTestStore(t)
+	saveTestEmail(t, store, FolderInbox, "k1", time.Now())
+	saveTestEmail(t, store, FolderInbox, "k2", time.Now())
+	// Sent mail starts out read
+	saveTestEmail(t, store, FolderSent, "k3", time.Now())
+
+	counts, err := store.RetrieveAllFolderCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]FolderCounts{
+		FolderInbox: {Total: 2, Unread: 2},
+		FolderSent:  {Total: 1},
+		FolderTrash: {},
+	}
+	for folder, wantCounts := range want {
+		if counts[folder] != wantCounts {
+			t.Errorf("%s counts are %+v, want %+v", folder, counts[folder], wantCounts)
+		}
+	}
+	for folder := range counts {
+		if _, ok := want[folder]; !ok {
+			t.Errorf("counts returned for %s", folder)
+		}
+	}
+}
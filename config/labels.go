@@ -0,0 +1,304 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Buckets of the labels. A message can carry any number of labels without
+// its EML being saved more than once.
+const (
+	// labelsBucket maps the name of every label to its labelRecord.
+	labelsBucket = "labels"
+	// labelIndexBucket holds one nested bucket per label with a key per
+	// labeled message: its folder, a NUL byte and its key.
+	labelIndexBucket = "label_index"
+)
+
+// ErrLabelExists is returned when creating or renaming to a label that
+// already exists.
+var ErrLabelExists = errors.New("label already exists")
+
+// Label is a label and the number of messages that carry it.
+type Label struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type labelRecord struct {
+	Created time.Time `json:"created"`
+}
+
+// ListLabels returns every label by name.
+func (s *Store) ListLabels() ([]Label, error) {
+	var labels []Label
+	err := s.db.View(func(tx *bolt.Tx) error {
+		registry := tx.Bucket([]byte(labelsBucket))
+		if registry == nil {
+			return nil
+		}
+		return registry.ForEach(func(k, v []byte) error {
+			label := Label{Name: string(k)}
+			if index := nestedBucket(tx, labelIndexBucket, label.Name); index != nil {
+				label.Count = index.Stats().KeyN
+			}
+			labels = append(labels, label)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list labels: %v", err)
+	}
+	return labels, nil
+}
+
+// CreateLabel creates a label.
+func (s *Store) CreateLabel(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("label name is empty")
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if labelExists(tx, name) {
+			return ErrLabelExists
+		}
+		return registerLabel(tx, name)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create label %s: %w", name, err)
+	}
+	return nil
+}
+
+// RenameLabel renames a label on every message that carries it.
+func (s *Store) RenameLabel(name, newName string) error {
+	if strings.TrimSpace(newName) == "" {
+		return errors.New("label name is empty")
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if !labelExists(tx, name) {
+			return fmt.Errorf("label %q does not exist", name)
+		}
+		if labelExists(tx, newName) {
+			return ErrLabelExists
+		}
+		if err := registerLabel(tx, newName); err != nil {
+			return err
+		}
+
+		err := forEachLabeled(tx, name, func(folder string, key []byte) error {
+			return relabel(tx, folder, key, []string{newName}, []string{name})
+		})
+		if err != nil {
+			return err
+		}
+		return dropLabel(tx, name)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rename label %s: %w", name, err)
+	}
+	return nil
+}
+
+// DeleteLabel removes a label from every message that carries it and
+// deletes it. The messages stay in their folders.
+func (s *Store) DeleteLabel(name string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if !labelExists(tx, name) {
+			return fmt.Errorf("label %q does not exist", name)
+		}
+		err := forEachLabeled(tx, name, func(folder string, key []byte) error {
+			return relabel(tx, folder, key, nil, []string{name})
+		})
+		if err != nil {
+			return err
+		}
+		return dropLabel(tx, name)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete label %s: %w", name, err)
+	}
+	return nil
+}
+
+// AddLabels adds labels to the messages saved under keys in folder. Labels
+// that do not exist yet are created.
+func (s *Store) AddLabels(folder string, keys, labels []string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, label := range labels {
+			if strings.TrimSpace(label) == "" {
+				return errors.New("label name is empty")
+			}
+			if !labelExists(tx, label) {
+				if err := registerLabel(tx, label); err != nil {
+					return err
+				}
+			}
+		}
+		for _, key := range keys {
+			if err := relabel(tx, folder, []byte(key), labels, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add labels: %v", err)
+	}
+	return nil
+}
+
+// RemoveLabels removes labels from the messages saved under keys in folder.
+func (s *Store) RemoveLabels(folder string, keys, labels []string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if err := relabel(tx, folder, []byte(key), nil, labels); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove labels: %v", err)
+	}
+	return nil
+}
+
+// RetrieveLabel returns the messages that carry a label, newest first.
+func (s *Store) RetrieveLabel(label string) ([]StoredEmail, error) {
+	var emails []StoredEmail
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return forEachLabeled(tx, label, func(folder string, key []byte) error {
+			bucket := tx.Bucket([]byte(folder))
+			if bucket == nil {
+				return nil
+			}
+			email := StoredEmail{Folder: folder, Key: string(key), EML: string(bucket.Get(key))}
+			if meta, err := getMeta(nestedBucket(tx, messageMetaBucket, folder), key); err == nil && meta != nil {
+				email.Received = meta.Received
+				email.Flags = meta.Flags
+				email.Labels = meta.Labels
+			}
+			emails = append(emails, email)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve label %s: %v", label, err)
+	}
+
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].Received.After(emails[j].Received)
+	})
+	return emails, nil
+}
+
+// relabel adds and removes labels on the message saved under key in folder.
+// Messages that are not in the folder are ignored.
+func relabel(tx *bolt.Tx, folder string, key []byte, add, remove []string) error {
+	metas := nestedBucket(tx, messageMetaBucket, folder)
+	meta, err := getMeta(metas, key)
+	if err != nil || meta == nil {
+		return err
+	}
+
+	if err := unlabelMessage(tx, folder, key, remove); err != nil {
+		return err
+	}
+	for _, label := range remove {
+		meta.Labels = removeID(meta.Labels, label)
+	}
+	for _, label := range add {
+		meta.Labels = appendID(meta.Labels, label)
+	}
+	sort.Strings(meta.Labels)
+	if err := labelMessage(tx, folder, key, add); err != nil {
+		return err
+	}
+	return putJSON(metas, string(key), meta)
+}
+
+// labelMessage adds the message saved under key in folder to the index of
+// each label.
+func labelMessage(tx *bolt.Tx, folder string, key []byte, labels []string) error {
+	for _, label := range labels {
+		index, err := createNestedBucket(tx, labelIndexBucket, label)
+		if err != nil {
+			return err
+		}
+		if err := index.Put(labelIndexKey(folder, key), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlabelMessage removes the message saved under key in folder from the
+// index of each label.
+func unlabelMessage(tx *bolt.Tx, folder string, key []byte, labels []string) error {
+	for _, label := range labels {
+		if index := nestedBucket(tx, labelIndexBucket, label); index != nil {
+			if err := index.Delete(labelIndexKey(folder, key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// forEachLabeled calls fn with the folder and key of every message that
+// carries label. fn may change the label's index.
+func forEachLabeled(tx *bolt.Tx, label string, fn func(folder string, key []byte) error) error {
+	index := nestedBucket(tx, labelIndexBucket, label)
+	if index == nil {
+		return nil
+	}
+
+	var entries [][]byte
+	index.ForEach(func(k, v []byte) error {
+		entries = append(entries, append([]byte{}, k...))
+		return nil
+	})
+	for _, entry := range entries {
+		folder, key, ok := strings.Cut(string(entry), "\x00")
+		if !ok {
+			continue
+		}
+		if err := fn(folder, []byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func labelIndexKey(folder string, key []byte) []byte {
+	return append([]byte(folder+"\x00"), key...)
+}
+
+func labelExists(tx *bolt.Tx, name string) bool {
+	registry := tx.Bucket([]byte(labelsBucket))
+	return registry != nil && registry.Get([]byte(name)) != nil
+}
+
+func registerLabel(tx *bolt.Tx, name string) error {
+	registry, err := tx.CreateBucketIfNotExists([]byte(labelsBucket))
+	if err != nil {
+		return err
+	}
+	return putJSON(registry, name, labelRecord{Created: time.Now()})
+}
+
+func dropLabel(tx *bolt.Tx, name string) error {
+	if index := tx.Bucket([]byte(labelIndexBucket)); index != nil {
+		if err := index.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(labelsBucket)).Delete([]byte(name))
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLabels(t *testing.T) {
+	store := openTestStore(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	saveTestEmail(t, store, FolderInbox, "k1", start)
+	saveTestEmail(t, store, FolderSent, "k2", start.Add(time.Hour))
+
+	if err := store.CreateLabel("work"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateLabel("work"); !errors.Is(err, ErrLabelExists) {
+		t.Errorf("creating an existing label returned %v, want ErrLabelExists", err)
+	}
+	if err := store.CreateLabel(" "); err == nil {
+		t.Error("an empty label name was not rejected")
+	}
+
+	// Adding a label that does not exist creates it
+	if err := store.AddLabels(FolderInbox, []string{"k1"}, []string{"work", "urgent"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddLabels(FolderSent, []string{"k2"}, []string{"work"}); err != nil {
+		t.Fatal(err)
+	}
+	assertLabels(t, store, map[string]int{"urgent": 1, "work": 2})
+	assertLabeled(t, store, "work", "k2", "k1")
+
+	if err := store.RenameLabel("work", "urgent"); !errors.Is(err, ErrLabelExists) {
+		t.Errorf("renaming onto an existing label returned %v, want ErrLabelExists", err)
+	}
+	if err := store.RenameLabel("home", "house"); err == nil {
+		t.Error("renaming a missing label was not rejected")
+	}
+	if err := store.RenameLabel("work", "office"); err != nil {
+		t.Fatal(err)
+	}
+	assertLabels(t, store, map[string]int{"office": 2, "urgent": 1})
+	assertLabeled(t, store, "office", "k2", "k1")
+	assertLabeled(t, store, "work")
+
+	if err := store.RemoveLabels(FolderSent, []string{"k2"}, []string{"office"}); err != nil {
+		t.Fatal(err)
+	}
+	assertLabeled(t, store, "office", "k1")
+
+	// Deleting a label keeps its messages
+	if err := store.DeleteLabel("office"); err != nil {
+		t.Fatal(err)
+	}
+	assertLabels(t, store, map[string]int{"urgent": 1})
+	assertKeys(t, store, FolderInbox, "k1")
+	if err := store.DeleteLabel("office"); err == nil {
+		t.Error("deleting a missing label was not rejected")
+	}
+
+	// A deleted message leaves its labels
+	if err := store.DeleteEmails(FolderInbox, []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteEmails(FolderTrash, []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+	assertLabels(t, store, map[string]int{"urgent": 0})
+}
+
+func assertLabels(t *testing.T, store *Store, want map[string]int) {
+	t.Helper()
+	labels, err := store.ListLabels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int{}
+	for _, label := range labels {
+		got[label.Name] = label.Count
+	}
+	if len(got) != len(want) {
+		t.Errorf("labels are %v, want %v", got, want)
+		return
+	}
+	for name, count := range want {
+		if c, ok := got[name]; !ok || c != count {
+			t.Errorf("labels are %v, want %v", got, want)
+			return
+		}
+	}
+}
+
+// assertLabeled checks the keys of the messages carrying label, newest first.
+func assertLabeled(t *testing.T, store *Store, label string, want ...string) {
+	t.Helper()
+	emails, err := store.RetrieveLabel(label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, email := range emails {
+		got = append(got, email.Key)
+	}
+	if len(got) != len(want) {
+		t.Errorf("label %s holds %v, want %v", label, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("label %s holds %v, want %v", label, got, want)
+			return
+		}
+	}
+}
@@ -6,13 +6,133 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"gopkg.in/ini.v1"
 )
 
+// ConfigFile is the JSON file AstroMail keeps its settings and setup state in.
+const ConfigFile = "Config.Json"
+
+// Defaults used when the config file does not set the AWS connection.
+const (
+	DefaultAWSProfile = "AstroMailApp"
+	DefaultAWSRegion  = "us-east-1"
+)
+
+// AWSProfile returns the shared credentials profile AstroMail uses.
+func AWSProfile() string {
+	return readKeyOrDefault("Profile", DefaultAWSProfile)
+}
+
+// AWSRegion returns the AWS region AstroMail's stack lives in.
+func AWSRegion() string {
+	return readKeyOrDefault("Region", DefaultAWSRegion)
+}
+
+// AWSEndpoint returns the custom AWS endpoint URL, or "" to use AWS itself.
+func AWSEndpoint() string {
+	return readKeyOrDefault("Endpoint", "")
+}
+
+// S3Endpoint returns the endpoint URL for S3 alone, such as a MinIO server.
+// It falls back to AWSEndpoint.
+func S3Endpoint() string {
+	return readKeyOrDefault("S3 Endpoint", AWSEndpoint())
+}
+
+// SESEndpoint returns the endpoint URL for SES alone. It falls back to AWSEndpoint.
+func SESEndpoint() string {
+	return readKeyOrDefault("SES Endpoint", AWSEndpoint())
+}
+
+// S3PathStyle reports whether S3 requests put the bucket in the path instead
+// of the host name, which MinIO and LocalStack need.
+func S3PathStyle() bool {
+	return readKeyOrDefault("S3 Path Style", "false") == "true"
+}
+
+// AWSStaticCredentials returns the access key saved in the config file for
+// local stand-ins such as LocalStack. Both are "" when the shared credentials
+// profile should be used instead.
+func AWSStaticCredentials() (accessKeyID, secretAccessKey string) {
+	return readKeyOrDefault("Access Key ID", ""), readKeyOrDefault("Secret Access Key", "")
+}
+
+// TrashDays returns how many days deleted mail stays in the trash before it
+// is deleted for good.
+func TrashDays() int {
+	days, err := strconv.Atoi(readKeyOrDefault("Trash Days", "30"))
+	if err != nil || days < 1 {
+		return 30
+	}
+	return days
+}
+
+// SyncConcurrency returns how many messages are downloaded at once when the
+// inbox is refreshed.
+func SyncConcurrency() int {
+	concurrency, err := strconv.Atoi(readKeyOrDefault("Sync Concurrency", "8"))
+	if err != nil || concurrency < 1 {
+		return 8
+	}
+	return concurrency
+}
+
+// SyncInterval returns how often the inbox is synced in the background, from
+// a duration like "5m". Zero turns background sync off.
+func SyncInterval() time.Duration {
+	interval, err := time.ParseDuration(readKeyOrDefault("Sync Interval", "5m"))
+	if err != nil || interval < 0 {
+		return 5 * time.Minute
+	}
+	return interval
+}
+
+// NotificationsEnabled reports whether new mail shows a desktop notification.
+func NotificationsEnabled() bool {
+	return readKeyOrDefault("Notifications", "true") != "false"
+}
+
+// Retention policies for mail left in the bucket after it is saved locally.
+const (
+	RetentionKeep    = "keep"
+	RetentionArchive = "archive"
+	RetentionDelete  = "delete"
+)
+
+// Retention returns what happens to a message in the bucket once its local
+// copy is verified: it is kept, moved under archive/ or deleted.
+func Retention() string {
+	switch policy := readKeyOrDefault("Retention", RetentionKeep); policy {
+	case RetentionArchive, RetentionDelete:
+		return policy
+	}
+	return RetentionKeep
+}
+
+// GlacierDays returns how many days archived mail stays in S3 Standard before
+// a lifecycle rule moves it to Glacier. Zero means no rule.
+func GlacierDays() int {
+	days, err := strconv.Atoi(readKeyOrDefault("Glacier Days", "0"))
+	if err != nil || days < 0 {
+		return 0
+	}
+	return days
+}
+
+func readKeyOrDefault(key, fallback string) string {
+	value, err := ReadKeyFromFile(ConfigFile, key)
+	if err != nil || value == "" {
+		return fallback
+	}
+	return value
+}
+
 // GetAWSCredentials reads the AWS credentials file and returns the access key id and secret access key for the specified profile.
 func GetAWSCredentials() (accessKeyID, secretAccessKey string, err error) {
-	profileName := "AstroMailApp"
+	profileName := AWSProfile()
 	// Find the user's home directory.
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -55,7 +175,9 @@ func WriteKeyToFile(key, value, filename string) error {
 	_, err := os.Stat(filename)
 	if os.IsNotExist(err) {
 		// If the file does not exist, create it
-		return createNewFile(filename)
+		if err := createNewFile(filename); err != nil {
+			return err
+		}
 	}
 
 	file, err := os.Open(filename)
@@ -95,7 +217,7 @@ func WriteKeyToFile(key, value, filename string) error {
 }
 
 func CreateConfig() {
-	filename := "Config.Json"
+	filename := ConfigFile
 	// Check if the file exists
 	_, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -156,7 +278,7 @@ func ReadKeyFromFile(filename, key string) (string, error) {
 }
 
 func AddAWSProfile(awsID, awsSecret string) error {
-	profileName := "AstroMailApp"
+	profileName := AWSProfile()
 	// Determine the credentials file path.
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -0,0 +1,521 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+)
+
+// Buckets of the full-text index. A document is a saved message, named by its
+// folder, a NUL byte and its key.
+const (
+	// searchIndexBucket has a key per term and document: the term, a NUL
+	// byte and the document.
+	searchIndexBucket = "search_index"
+	// searchDocsBucket maps a document to its searchDoc.
+	searchDocsBucket = "search_docs"
+)
+
+// Bounds on what goes into the index.
+const (
+	minTermLength = 2
+	maxTermLength = 64
+)
+
+// searchBackfillBatch is how many messages backfillSearch extracts between
+// write transactions.
+const searchBackfillBatch = 200
+
+// SearchText is the text of a message that search looks in. The store does
+// not parse mail; OpenStore is given a SearchExtractor that does.
+type SearchText struct {
+	// From and To hold display names and addresses; To includes Cc and Bcc.
+	From    []string
+	To      []string
+	Subject string
+	// Body is the readable text of the message.
+	Body string
+	// Attachments are the filenames of its attachments.
+	Attachments []string
+	// HasAttachment is set if any attachment is not an inline image.
+	HasAttachment bool
+}
+
+// SearchExtractor returns the SearchText of a raw message.
+type SearchExtractor func(eml string) SearchText
+
+// searchDoc is the list of terms a message is indexed under, kept to take it
+// out of the index again.
+type searchDoc struct {
+	Terms []string `json:"terms"`
+}
+
+// SearchResults is one page of messages matching a query, newest first.
+type SearchResults struct {
+	Emails []StoredEmail
+	// Next is the cursor of the following page, or "" if this is the last.
+	Next  string
+	Total int
+}
+
+// Query is a parsed search query. Every condition must hold for a message to
+// match.
+type Query struct {
+	// Terms match any indexed field: subject, addresses, text and attachment
+	// filenames.
+	Terms   []string
+	From    []string
+	To      []string
+	Subject []string
+	// In limits the search to a folder and its subfolders. Without it the
+	// trash is left out.
+	In            string
+	Label         string
+	HasAttachment bool
+	Unread        bool
+	Read          bool
+	Flagged       bool
+	// Before and After bound the received time: Before is exclusive and
+	// After inclusive. Zero means unbounded.
+	Before time.Time
+	After  time.Time
+}
+
+// ParseQuery parses a search like
+//
+//	from:alice subject:"quarterly report" has:attachment after:2024-01-01
+//
+// Words without an operator, or with one it does not know, are searched in
+// every field. Quoted values may contain spaces.
+func ParseQuery(query string) (*Query, error) {
+	q := &Query{}
+	for _, word := range splitQuery(query) {
+		operator, value, ok := strings.Cut(word, ":")
+		if !ok || value == "" {
+			q.Terms = append(q.Terms, searchTerms(word)...)
+			continue
+		}
+		value = strings.Trim(value, `"`)
+
+		switch strings.ToLower(operator) {
+		case "from":
+			q.From = append(q.From, searchTerms(value)...)
+		case "to":
+			q.To = append(q.To, searchTerms(value)...)
+		case "subject":
+			q.Subject = append(q.Subject, searchTerms(value)...)
+		case "in":
+			q.In = strings.ToLower(value)
+		case "label":
+			q.Label = value
+		case "has":
+			if strings.ToLower(value) != "attachment" {
+				return nil, fmt.Errorf("unknown search has:%s", value)
+			}
+			q.HasAttachment = true
+		case "is":
+			switch strings.ToLower(value) {
+			case "unread":
+				q.Unread = true
+			case "read":
+				q.Read = true
+			case "flagged", "starred":
+				q.Flagged = true
+			default:
+				return nil, fmt.Errorf("unknown search is:%s", value)
+			}
+		case "before", "after":
+			date, err := parseQueryDate(value)
+			if err != nil {
+				return nil, err
+			}
+			if strings.ToLower(operator) == "before" {
+				q.Before = date
+			} else {
+				q.After = date
+			}
+		default:
+			q.Terms = append(q.Terms, searchTerms(word)...)
+		}
+	}
+	return q, nil
+}
+
+// Search returns up to limit messages matching query after cursor, newest
+// first. An empty cursor returns the first page.
+func (s *Store) Search(query *Query, cursor string, limit int) (*SearchResults, error) {
+	offset := 0
+	if cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(cursor); err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid cursor %q", cursor)
+		}
+	}
+
+	results := &SearchResults{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		docs, err := matchingDocs(tx, query)
+		if err != nil {
+			return err
+		}
+
+		var matches []StoredEmail
+		for _, doc := range docs {
+			folder, key, _ := strings.Cut(doc, "\x00")
+			meta, err := getMeta(nestedBucket(tx, messageMetaBucket, folder), []byte(key))
+			if err != nil {
+				return err
+			}
+			if meta == nil || !query.matchesMeta(folder, meta) {
+				continue
+			}
+			matches = append(matches, StoredEmail{
+				Folder:   folder,
+				Key:      key,
+				Received: meta.Received,
+				Flags:    meta.Flags,
+				Labels:   meta.Labels,
+			})
+		}
+
+		sort.SliceStable(matches, func(i, j int) bool {
+			return matches[i].Received.After(matches[j].Received)
+		})
+		results.Total = len(matches)
+		if offset > len(matches) {
+			offset = len(matches)
+		}
+		end := offset + limit
+		if end >= len(matches) {
+			end = len(matches)
+		} else {
+			results.Next = strconv.Itoa(end)
+		}
+
+		results.Emails = matches[offset:end]
+		for i, email := range results.Emails {
+			results.Emails[i].EML = string(tx.Bucket([]byte(email.Folder)).Get([]byte(email.Key)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search: %v", err)
+	}
+	return results, nil
+}
+
+// RebuildSearchIndex indexes every saved message again from its EML.
+func (s *Store) RebuildSearchIndex() error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{searchIndexBucket, searchDocsBucket} {
+			if err := tx.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = s.backfillSearch()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rebuild search index: %v", err)
+	}
+	return nil
+}
+
+// backfillSearch indexes every message that has no search document, such as
+// mail saved before the search index existed. Messages are read and indexed
+// in batches, and their text is extracted between transactions so the
+// database is not locked while mail is parsed.
+func (s *Store) backfillSearch() error {
+	type pending struct {
+		folder, key, eml string
+	}
+	for {
+		var batch []pending
+		err := s.db.View(func(tx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+				folder := string(name)
+				if internalBuckets[folder] {
+					return nil
+				}
+				c := bucket.Cursor()
+				for k, v := c.First(); k != nil && len(batch) < searchBackfillBatch; k, v = c.Next() {
+					if doc, err := getSearchDoc(tx, folder, k); err == nil && doc == nil {
+						batch = append(batch, pending{folder, string(k), string(v)})
+					}
+				}
+				return nil
+			})
+		})
+		if err != nil || len(batch) == 0 {
+			return err
+		}
+
+		docs := make([]*searchDoc, len(batch))
+		for i, message := range batch {
+			docs[i] = s.searchDoc(message.eml)
+		}
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			for i, message := range batch {
+				// Skip messages moved or deleted since they were read
+				bucket := tx.Bucket([]byte(message.folder))
+				if bucket == nil || bucket.Get([]byte(message.key)) == nil {
+					continue
+				}
+				if err := indexSearchDoc(tx, message.folder, []byte(message.key), docs[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// searchDoc extracts the text of eml and returns the terms to index it
+// under. Without an extractor a message is indexed under none and only
+// found by filters.
+func (s *Store) searchDoc(eml string) *searchDoc {
+	if s.extract == nil {
+		return &searchDoc{}
+	}
+	return buildSearchDoc(s.extract(eml))
+}
+
+// matchingDocs returns the documents that have every term of query, or all
+// documents if it has none.
+func matchingDocs(tx *bolt.Tx, query *Query) ([]string, error) {
+	var terms []string
+	terms = append(terms, query.Terms...)
+	terms = append(terms, fieldTerms("from", query.From)...)
+	terms = append(terms, fieldTerms("to", query.To)...)
+	terms = append(terms, fieldTerms("subject", query.Subject)...)
+	if query.HasAttachment {
+		terms = append(terms, "has:attachment")
+	}
+
+	if len(terms) == 0 {
+		var docs []string
+		if bucket := tx.Bucket([]byte(searchDocsBucket)); bucket != nil {
+			bucket.ForEach(func(k, v []byte) error {
+				docs = append(docs, string(k))
+				return nil
+			})
+		}
+		return docs, nil
+	}
+
+	index := tx.Bucket([]byte(searchIndexBucket))
+	if index == nil {
+		return nil, nil
+	}
+	var matched map[string]bool
+	for _, term := range terms {
+		docs := map[string]bool{}
+		prefix := term + "\x00"
+		c := index.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			doc := string(k[len(prefix):])
+			if matched == nil || matched[doc] {
+				docs[doc] = true
+			}
+		}
+		matched = docs
+		if len(matched) == 0 {
+			return nil, nil
+		}
+	}
+
+	docs := make([]string, 0, len(matched))
+	for doc := range matched {
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// matchesMeta checks the conditions of q that are not in the index.
+func (q *Query) matchesMeta(folder string, meta *messageMeta) bool {
+	switch {
+	case q.In == "" && folder == FolderTrash:
+		return false
+	case q.In != "" && !strings.EqualFold(folder, q.In) &&
+		!strings.HasPrefix(strings.ToLower(folder), q.In+FolderSeparator):
+		return false
+	case q.Label != "" && !containsID(meta.Labels, q.Label):
+		return false
+	case q.Unread && meta.hasFlag(FlagSeen), q.Read && !meta.hasFlag(FlagSeen):
+		return false
+	case q.Flagged && !meta.hasFlag(FlagFlagged):
+		return false
+	case !q.Before.IsZero() && !meta.Received.Before(q.Before):
+		return false
+	case !q.After.IsZero() && meta.Received.Before(q.After):
+		return false
+	}
+	return true
+}
+
+// buildSearchDoc returns the terms to index a message with text under.
+func buildSearchDoc(text SearchText) *searchDoc {
+	terms := map[string]bool{}
+	add := func(field string, text string) {
+		for _, term := range searchTerms(text) {
+			terms[term] = true
+			if field != "" {
+				terms[field+":"+term] = true
+			}
+		}
+	}
+
+	for _, from := range text.From {
+		add("from", from)
+	}
+	for _, to := range text.To {
+		add("to", to)
+	}
+	add("subject", text.Subject)
+	add("", text.Body)
+	for _, filename := range text.Attachments {
+		add("", filename)
+	}
+	if text.HasAttachment {
+		terms["has:attachment"] = true
+	}
+
+	doc := &searchDoc{Terms: make([]string, 0, len(terms))}
+	for term := range terms {
+		doc.Terms = append(doc.Terms, term)
+	}
+	sort.Strings(doc.Terms)
+	return doc
+}
+
+// indexSearchDoc adds the message saved under key in folder to the index,
+// replacing what it was indexed under before.
+func indexSearchDoc(tx *bolt.Tx, folder string, key []byte, doc *searchDoc) error {
+	if err := unindexSearchDoc(tx, folder, key); err != nil {
+		return err
+	}
+
+	docs, err := tx.CreateBucketIfNotExists([]byte(searchDocsBucket))
+	if err != nil {
+		return err
+	}
+	index, err := tx.CreateBucketIfNotExists([]byte(searchIndexBucket))
+	if err != nil {
+		return err
+	}
+
+	id := searchDocID(folder, key)
+	for _, term := range doc.Terms {
+		if err := index.Put([]byte(term+"\x00"+id), nil); err != nil {
+			return err
+		}
+	}
+	return putJSON(docs, id, doc)
+}
+
+// unindexSearchDoc takes the message saved under key in folder out of the
+// index.
+func unindexSearchDoc(tx *bolt.Tx, folder string, key []byte) error {
+	doc, err := getSearchDoc(tx, folder, key)
+	if err != nil || doc == nil {
+		return err
+	}
+
+	id := searchDocID(folder, key)
+	index := tx.Bucket([]byte(searchIndexBucket))
+	for _, term := range doc.Terms {
+		if err := index.Delete([]byte(term + "\x00" + id)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(searchDocsBucket)).Delete([]byte(id))
+}
+
+func getSearchDoc(tx *bolt.Tx, folder string, key []byte) (*searchDoc, error) {
+	docs := tx.Bucket([]byte(searchDocsBucket))
+	if docs == nil {
+		return nil, nil
+	}
+	value := docs.Get([]byte(searchDocID(folder, key)))
+	if value == nil {
+		return nil, nil
+	}
+	var doc searchDoc
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func searchDocID(folder string, key []byte) string {
+	return folder + "\x00" + string(key)
+}
+
+// searchTerms splits text into lowercase words of letters and digits, so
+// "Alice.Smith@example.com" is found by "alice", "smith" or "example".
+func searchTerms(text string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if n := len([]rune(word)); n >= minTermLength && n <= maxTermLength {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+func fieldTerms(field string, terms []string) []string {
+	prefixed := make([]string, len(terms))
+	for i, term := range terms {
+		prefixed[i] = field + ":" + term
+	}
+	return prefixed
+}
+
+// splitQuery splits a query at spaces outside double quotes.
+func splitQuery(query string) []string {
+	var words []string
+	var word strings.Builder
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			word.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+		default:
+			word.WriteRune(r)
+		}
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// parseQueryDate parses the date of a before: or after: search as a day in
+// local time.
+func parseQueryDate(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006/01/02", "2006-1-2", "2006/1/2"} {
+		if date, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid search date %q, use YYYY-MM-DD", value)
+}
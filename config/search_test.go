@@ -0,0 +1,156 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  Query
+	}{
+		{"Quarterly report", Query{Terms: []string{"quarterly", "report"}}},
+		{`from:alice subject:"Quarterly report"`, Query{From: []string{"alice"}, Subject: []string{"quarterly", "report"}}},
+		{"to:bob@example.com", Query{To: []string{"bob", "example", "com"}}},
+		{"in:Work/Projects label:Urgent", Query{In: "work/projects", Label: "Urgent"}},
+		{"has:attachment is:unread is:starred", Query{HasAttachment: true, Unread: true, Flagged: true}},
+		{"is:read", Query{Read: true}},
+		{
+			"after:2024-01-01 before:2024/2/1",
+			Query{After: time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local), Before: time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local)},
+		},
+		// Unknown operators and bare colons are searched as words
+		{"re:meeting", Query{Terms: []string{"re", "meeting"}}},
+		{"note:", Query{Terms: []string{"note"}}},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(*q, tt.want) {
+			t.Errorf("ParseQuery(%q) = %+v, want %+v", tt.query, *q, tt.want)
+		}
+	}
+
+	for _, query := range []string{"has:pictures", "is:important", "after:yesterday"} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("ParseQuery(%q) was not rejected", query)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	store := openTestStore(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	save := func(folder, key, from, subject, body, attachment string, received time.Time) {
+		t.Helper()
+		if err := store.SaveEmail(key, testEmail(from, subject, body, attachment, received), folder); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save(FolderInbox, "report", "Alice Smith <alice@example.com>", "Quarterly report", "Numbers attached", "q1.pdf", start)
+	save(FolderInbox, "lunch", "Bob <bob@example.com>", "Lunch", "Tacos on Friday?", "", start.Add(24*time.Hour))
+	save("work", "review", "Alice Smith <alice@example.com>", "Re: Quarterly report", "Looks good", "", start.Add(48*time.Hour))
+	save("work/projects", "plan", "Carol <carol@example.com>", "Project plan", "Milestones for the report", "", start.Add(72*time.Hour))
+	save(FolderTrash, "old", "Alice Smith <alice@example.com>", "Old report", "Deleted", "", start.Add(96*time.Hour))
+	if _, err := store.SetFlags(FolderInbox, []string{"lunch"}, []string{FlagSeen, FlagFlagged}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddLabels("work", []string{"review"}, []string{"urgent"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// The trash is only searched when asked for
+		{"report", "plan,review,report"},
+		{"report in:trash", "old"},
+		{"from:alice", "review,report"},
+		{"from:alice to:me", "review,report"},
+		{"from:bob subject:report", ""},
+		{`subject:"quarterly report"`, "review,report"},
+		{"smith", "review,report"},
+		{"q1", "report"},
+		{"has:attachment", "report"},
+		{"in:work", "plan,review"},
+		{"in:Work/projects", "plan"},
+		{"label:urgent", "review"},
+		{"is:unread in:inbox", "report"},
+		{"is:read", "lunch"},
+		{"is:flagged", "lunch"},
+		{"after:2024-03-02 before:2024-03-04", "review,lunch"},
+		{"", "plan,review,lunch,report"},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := store.Search(q, "", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := searchKeys(results); got != tt.want {
+			t.Errorf("Search(%q) found %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	// Moving a message takes its search terms along
+	if err := store.MoveEmails("work", FolderInbox, []string{"review"}); err != nil {
+		t.Fatal(err)
+	}
+	q, _ := ParseQuery("looks in:inbox")
+	if results, _ := store.Search(q, "", 10); searchKeys(results) != "review" {
+		t.Errorf("moved message found as %s", searchKeys(results))
+	}
+
+	// Pages continue from the cursor
+	q, _ = ParseQuery("")
+	var pages []string
+	for cursor := ""; ; {
+		results, err := store.Search(q, cursor, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results.Total != 4 {
+			t.Errorf("search total is %d", results.Total)
+		}
+		pages = append(pages, searchKeys(results))
+		if cursor = results.Next; cursor == "" {
+			break
+		}
+	}
+	if got := strings.Join(pages, "|"); got != "plan,review,lunch|report" {
+		t.Errorf("search pages are %s", got)
+	}
+	if _, err := store.Search(q, "-1", 3); err == nil {
+		t.Error("an invalid cursor was not rejected")
+	}
+
+	// Rebuilding finds the same messages
+	if err := store.RebuildSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	q, _ = ParseQuery("from:alice")
+	if results, _ := store.Search(q, "", 10); searchKeys(results) != "review,report" {
+		t.Errorf("after rebuilding, from:alice found %s", searchKeys(results))
+	}
+}
+
+func searchKeys(results *SearchResults) string {
+	var keys []string
+	for _, email := range results.Emails {
+		if email.EML == "" {
+			return "message without EML"
+		}
+		keys = append(keys, email.Key)
+	}
+	return strings.Join(keys, ",")
+}
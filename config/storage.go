@@ -1,57 +1,112 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
-// SaveEmail saves the EML string in the database with the given message ID as the key.
-func SaveEmail(messageID, emlString, dbName string) error {
-	// Open the BoltDB database.
-	db, err := bolt.Open("emails.db", 0600, nil)
-	if err != nil {
-		return fmt.Errorf("failed to open database: %v", err)
+// legacyStorePath is where older versions kept the mail database, in the
+// working directory.
+const legacyStorePath = "emails.db"
+
+// ErrEmailExists is returned by SaveEmail when the message ID is already
+// saved in the bucket.
+var ErrEmailExists = errors.New("message ID already exists in the database")
+
+// Store is the local mail database. It is opened once and shared; every
+// method runs in a single transaction.
+type Store struct {
+	db      *bolt.DB
+	extract SearchExtractor
+}
+
+// StorePath returns where the mail database lives: the "Database Path"
+// setting, or emails.db in AstroMail's directory under the user config
+// directory.
+func StorePath() (string, error) {
+	if path := readKeyOrDefault("Database Path", ""); path != "" {
+		return path, nil
 	}
-	defer db.Close()
 
-	// Start a read-only transaction.
-	err = db.View(func(tx *bolt.Tx) error {
-		// Retrieve the bucket.
-		bucket := tx.Bucket([]byte(dbName))
-		if bucket == nil {
-			// If the bucket does not exist, return nil.
-			return nil
-		}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to find user config directory: %w", err)
+	}
+	return filepath.Join(configDir, "AstroMail", "emails.db"), nil
+}
 
-		// Check if the message ID already exists in the bucket.
-		existingValue := bucket.Get([]byte(messageID))
-		if existingValue != nil {
-			return fmt.Errorf("message ID %s already exists in the database", messageID)
-		}
+// OpenStore opens the mail database at path, creating it and its directory
+// if needed. A database left in the working directory by an older version is
+// copied there first. extract gives the text of a message for the search
+// index; messages not yet in the index are added to it.
+func OpenStore(path string, extract SearchExtractor) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %v", err)
+	}
+	if err := migrateLegacyStore(path); err != nil {
+		return nil, err
+	}
 
-		return nil
-	})
+	// Bolt locks the file; fail instead of hanging if another AstroMail has it open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
-		return fmt.Errorf("failed: %v", err)
+		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
-	// Start a new read-write transaction to update the database.
-	err = db.Update(func(tx *bolt.Tx) error {
+	if err := db.Update(registerFolders); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to register folders: %v", err)
+	}
+	if err := db.Update(backfillIndex); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to index database: %v", err)
+	}
+	store := &Store{db: db, extract: extract}
+	if err := store.backfillSearch(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to index database for search: %v", err)
+	}
+	return store, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// SaveEmail saves the EML string in the database with the given message ID as the key.
+func (s *Store) SaveEmail(messageID, emlString, dbName string) error {
+	// Extract the search text before taking the write lock
+	doc := s.searchDoc(emlString)
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		// Retrieve or create the bucket.
-		bucket, err := tx.CreateBucketIfNotExists([]byte(dbName))
-		if err != nil {
-			return err
+		if !folderExists(tx, dbName) {
+			if err := registerFolder(tx, dbName); err != nil {
+				return err
+			}
+		}
+		bucket := tx.Bucket([]byte(dbName))
+
+		// Check if the message ID already exists in the bucket.
+		if bucket.Get([]byte(messageID)) != nil {
+			return ErrEmailExists
 		}
 
 		// Add the EML string to the bucket with the message ID as the key.
-		err = bucket.Put([]byte(messageID), []byte(emlString))
-		if err != nil {
+		if err := bucket.Put([]byte(messageID), []byte(emlString)); err != nil {
 			return err
 		}
-
-		return nil
+		return indexEmail(tx, dbName, []byte(messageID), emlString, doc)
 	})
+	if err == ErrEmailExists {
+		return fmt.Errorf("message ID %s: %w", messageID, err)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to save email: %v", err)
 	}
@@ -60,18 +115,11 @@ func SaveEmail(messageID, emlString, dbName string) error {
 }
 
 // RetrieveEmails retrieves all saved email objects from the specified bucket in the database.
-func RetrieveEmails(dbName string) ([]string, error) {
-	// Open the BoltDB database.
-	db, err := bolt.Open("emails.db", 0600, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
-	}
-	defer db.Close()
-
+func (s *Store) RetrieveEmails(dbName string) ([]string, error) {
 	var emails []string
 
 	// Read-only transaction to retrieve emails from the specified bucket.
-	err = db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
 		// Retrieve the bucket.
 		bucket := tx.Bucket([]byte(dbName))
 		if bucket == nil {
@@ -80,15 +128,10 @@ func RetrieveEmails(dbName string) ([]string, error) {
 		}
 
 		// Iterate over all key-value pairs in the bucket.
-		if err := bucket.ForEach(func(k, v []byte) error {
-			// Append the email value to the emails slice.
+		return bucket.ForEach(func(k, v []byte) error {
 			emails = append(emails, string(v))
 			return nil
-		}); err != nil {
-			return fmt.Errorf("failed to iterate over bucket: %v", err)
-		}
-
-		return nil
+		})
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve emails: %v", err)
@@ -97,56 +140,99 @@ func RetrieveEmails(dbName string) ([]string, error) {
 	return emails, nil
 }
 
-// RetrieveEmailsPaginated retrieves emails in a paginated fashion from the specified bucket.
-func RetrieveEmailsPaginated(dbName string, pageNum int, pageSize int) ([]string, error) {
-	// Open the BoltDB database.
-	db, err := bolt.Open("emails.db", 0600, nil)
+// RetrieveEmail retrieves the email saved under messageID in the specified
+// bucket. It returns an empty string if there is none.
+func (s *Store) RetrieveEmail(dbName, messageID string) (string, error) {
+	var email string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(dbName))
+		if bucket == nil {
+			return nil
+		}
+		email = string(bucket.Get([]byte(messageID)))
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+		return "", fmt.Errorf("failed to retrieve email: %v", err)
 	}
-	defer db.Close()
 
-	var emails []string
-
-	// Calculate the starting index and the ending index for the items to be retrieved
-	startIndex := (pageNum - 1) * pageSize
-	endIndex := startIndex + pageSize
+	return email, nil
+}
 
-	// Initialize a counter to keep track of the current item index
-	counter := 0
+// FindEmail returns the folder and EML of the email saved under messageID,
+// looking in the inbox first and then in every other folder. The folder is
+// empty if none has it.
+func (s *Store) FindEmail(messageID string) (string, string, error) {
+	var folder, email string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(FolderInbox)); bucket != nil {
+			if v := bucket.Get([]byte(messageID)); v != nil {
+				folder, email = FolderInbox, string(v)
+				return nil
+			}
+		}
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			if folder != "" || internalBuckets[string(name)] {
+				return nil
+			}
+			if v := bucket.Get([]byte(messageID)); v != nil {
+				folder, email = string(name), string(v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find email: %v", err)
+	}
+	return folder, email, nil
+}
 
-	err = db.View(func(tx *bolt.Tx) error {
-		// Retrieve the bucket.
+// ForEachEmail calls fn with the message ID and EML string of every email
+// saved in the specified bucket. fn runs inside a read transaction and must
+// not write to the store.
+func (s *Store) ForEachEmail(dbName string, fn func(messageID, emlString string) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(dbName))
 		if bucket == nil {
-			return fmt.Errorf("bucket %s not found", dbName)
+			return nil
 		}
-
-		// Iterate over all items in the bucket.
 		return bucket.ForEach(func(k, v []byte) error {
-			if counter >= startIndex && counter < endIndex {
-				// If the current item is within the desired range, add it to the results
-				emails = append(emails, string(v))
-			}
-			// Increment the counter regardless of whether the item was added to the results
-			counter++
-			// If the counter has reached the end index, we can stop iterating
-			if counter >= endIndex {
-				return fmt.Errorf("stop iteration")
-			}
-			return nil
+			return fn(string(k), string(v))
 		})
 	})
+}
 
-	// It's normal to encounter the "stop iteration" error; it's our signal to stop early.
-	// We should not return it as an actual error to the caller.
-	if err != nil && err.Error() == "stop iteration" {
-		err = nil
+// migrateLegacyStore copies emails.db from the working directory to path if
+// there is no database at path yet.
+func migrateLegacyStore(path string) error {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return nil
 	}
-
+	absLegacy, err := filepath.Abs(legacyStorePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve emails: %v", err)
+		return nil
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil || absLegacy == absPath {
+		return nil
 	}
 
-	return emails, nil
+	legacy, err := os.Open(legacyStorePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open old database: %v", err)
+	}
+	defer legacy.Close()
+
+	migrated, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create database: %v", err)
+	}
+	if _, err := io.Copy(migrated, legacy); err != nil {
+		migrated.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to copy old database: %v", err)
+	}
+	return migrated.Close()
 }
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestStore opens a new store in a temporary directory and closes it
+// when the test ends.
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := OpenStore(filepath.Join(t.TempDir(), "emails.db"), testExtractor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// testEmail builds a plain message received at date. A non-empty attachment
+// is named in an X-Attachment header, which testExtractor reads.
+func testEmail(from, subject, body, attachment string, date time.Time) string {
+	eml := fmt.Sprintf("From: %s\r\nTo: me@example.com\r\nSubject: %s\r\nDate: %s\r\n", from, subject, date.Format(time.RFC1123Z))
+	if attachment != "" {
+		eml += "X-Attachment: " + attachment + "\r\n"
+	}
+	return eml + "\r\n" + body + "\r\n"
+}
+
+// testExtractor reads the search text of the messages testEmail builds.
+func testExtractor(eml string) SearchText {
+	msg, err := mail.ReadMessage(strings.NewReader(eml))
+	if err != nil {
+		return SearchText{}
+	}
+	body, _ := io.ReadAll(msg.Body)
+	text := SearchText{
+		From:    []string{msg.Header.Get("From")},
+		To:      []string{msg.Header.Get("To")},
+		Subject: msg.Header.Get("Subject"),
+		Body:    string(body),
+	}
+	if name := msg.Header.Get("X-Attachment"); name != "" {
+		text.Attachments = []string{name}
+		text.HasAttachment = true
+	}
+	return text
+}
+
+// saveTestEmail saves a message from testEmail under key in folder.
+func saveTestEmail(t *testing.T, store *Store, folder, key string, date time.Time) {
+	t.Helper()
+	eml := testEmail("Alice <alice@example.com>", "Message "+key, "Body of "+key, "", date)
+	if err := store.SaveEmail(key, eml, folder); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// folderKeys returns the keys saved in folder, newest first.
+func folderKeys(t *testing.T, store *Store, folder string) []string {
+	t.Helper()
+	page, err := store.RetrievePage(folder, "", 1000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, email := range page.Emails {
+		keys = append(keys, email.Key)
+	}
+	return keys
+}
+
+func TestSaveEmail(t *testing.T) {
+	store := openTestStore(t)
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	saveTestEmail(t, store, FolderInbox, "k1", date)
+
+	eml, err := store.RetrieveEmail(FolderInbox, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(eml, "Subject: Message k1") {
+		t.Errorf("RetrieveEmail returned %q", eml)
+	}
+	if eml, _ := store.RetrieveEmail(FolderInbox, "missing"); eml != "" {
+		t.Errorf("RetrieveEmail of a missing key returned %q", eml)
+	}
+
+	err = store.SaveEmail("k1", "duplicate", FolderInbox)
+	if !errors.Is(err, ErrEmailExists) {
+		t.Errorf("saving a key twice returned %v, want ErrEmailExists", err)
+	}
+	if eml, _ := store.RetrieveEmail(FolderInbox, "k1"); eml == "duplicate" {
+		t.Error("saving a key twice replaced the message")
+	}
+
+	// Saving to a folder that does not exist yet creates it
+	saveTestEmail(t, store, "archive", "k2", date)
+	assertFolders(t, store, "inbox", "sent", "trash", "archive")
+}
+
+func TestFindEmail(t *testing.T) {
+	store := openTestStore(t)
+	saveTestEmail(t, store, FolderInbox, "k1", time.Now())
+	if err := store.CreateFolder("work"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MoveEmails(FolderInbox, "work", []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	folder, eml, err := store.FindEmail("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder != "work" || !strings.Contains(eml, "Message k1") {
+		t.Errorf("FindEmail(k1) = %q, %q", folder, eml)
+	}
+
+	// The inbox copy is found first
+	if err := store.CopyEmails("work", FolderInbox, []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+	if folder, _, _ := store.FindEmail("k1"); folder != FolderInbox {
+		t.Errorf("FindEmail(k1) found it in %s", folder)
+	}
+
+	if folder, eml, err := store.FindEmail("missing"); folder != "" || eml != "" || err != nil {
+		t.Errorf("FindEmail(missing) = %q, %q, %v", folder, eml, err)
+	}
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// syncStateBucket maps a mail source, such as an S3 bucket, to its SyncState.
+const syncStateBucket = "sync_state"
+
+// syncOverlap is how far before the newest LastModified listings look again.
+// SES sets LastModified when it starts writing an object, so one that takes
+// longer to write can show up in a listing after newer ones.
+const syncOverlap = 10 * time.Minute
+
+// SyncState is how far the inbox has been synced from a source: the newest
+// LastModified time fetched so far and the keys fetched within syncOverlap
+// of it. An object is new when it was modified within that window under a
+// key that is not in Recent, or later.
+type SyncState struct {
+	LastModified time.Time `json:"lastModified"`
+	// Recent maps the keys fetched within syncOverlap of LastModified to
+	// when they were modified.
+	Recent map[string]time.Time `json:"recent,omitempty"`
+	// Keys are the keys fetched at exactly LastModified, as older versions
+	// kept them. RetrieveSyncState moves them to Recent.
+	Keys []string `json:"keys,omitempty"`
+	// Ahead are keys fetched on notification before a listing of the source
+	// reached them.
+	Ahead []string `json:"ahead,omitempty"`
+}
+
+// Synced reports whether the object with key last modified at modified has
+// already been fetched.
+func (st *SyncState) Synced(key string, modified time.Time) bool {
+	if modified.Before(st.LastModified.Add(-syncOverlap)) {
+		return true
+	}
+	_, ok := st.Recent[key]
+	return ok
+}
+
+// IsAhead reports whether the object with key was fetched on notification
+// and is still ahead of the listing.
+func (st *SyncState) IsAhead(key string) bool {
+	return containsID(st.Ahead, key)
+}
+
+// MarkAhead records that the object with key was fetched out of order.
+func (st *SyncState) MarkAhead(key string) {
+	st.Ahead = appendID(st.Ahead, key)
+}
+
+// Advance records that the object with key last modified at modified has
+// been fetched, and forgets keys that fell out of the overlap window.
+func (st *SyncState) Advance(key string, modified time.Time) {
+	st.Ahead = removeID(st.Ahead, key)
+	if modified.After(st.LastModified) {
+		st.LastModified = modified
+	}
+	if st.Recent == nil {
+		st.Recent = map[string]time.Time{}
+	}
+	st.Recent[key] = modified
+
+	cutoff := st.LastModified.Add(-syncOverlap)
+	for k, m := range st.Recent {
+		if m.Before(cutoff) {
+			delete(st.Recent, k)
+		}
+	}
+}
+
+// RetrieveSyncState returns the sync state of a source, or the zero state if
+// it has never been synced.
+func (s *Store) RetrieveSyncState(source string) (SyncState, error) {
+	var state SyncState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(syncStateBucket))
+		if bucket == nil {
+			return nil
+		}
+		if value := bucket.Get([]byte(source)); value != nil {
+			return json.Unmarshal(value, &state)
+		}
+		return nil
+	})
+	if err != nil {
+		return SyncState{}, fmt.Errorf("failed to read sync state: %v", err)
+	}
+	if len(state.Keys) > 0 {
+		if state.Recent == nil {
+			state.Recent = map[string]time.Time{}
+		}
+		for _, key := range state.Keys {
+			state.Recent[key] = state.LastModified
+		}
+		state.Keys = nil
+	}
+	return state, nil
+}
+
+// SaveSyncState saves the sync state of a source.
+func (s *Store) SaveSyncState(source string, state SyncState) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(syncStateBucket))
+		if err != nil {
+			return err
+		}
+		return putJSON(bucket, source, state)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save sync state: %v", err)
+	}
+	return nil
+}
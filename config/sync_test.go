@@ -0,0 +1,127 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestSyncState(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var state SyncState
+	if state.Synced("a", start) {
+		t.Error("a new state has synced an object")
+	}
+
+	state.Advance("a", start)
+	state.Advance("b", start.Add(time.Minute))
+	for _, tt := range []struct {
+		key      string
+		modified time.Time
+		want     bool
+	}{
+		{"a", start, true},
+		{"b", start.Add(time.Minute), true},
+		// An object SES finished writing late is still new inside the window
+		{"c", start, false},
+		{"c", start.Add(-syncOverlap + 2*time.Minute), false},
+		{"c", start.Add(-syncOverlap), true},
+		{"c", start.Add(2 * time.Minute), false},
+	} {
+		if got := state.Synced(tt.key, tt.modified); got != tt.want {
+			t.Errorf("Synced(%s, %v) = %v, want %v", tt.key, tt.modified.Sub(start), got, tt.want)
+		}
+	}
+
+	// Advancing over a late object keeps the watermark where it is
+	state.Advance("c", start.Add(-time.Minute))
+	if !state.LastModified.Equal(start.Add(time.Minute)) || !state.Synced("c", start.Add(-time.Minute)) {
+		t.Errorf("state after advancing over a late object is %+v", state)
+	}
+
+	// Keys that fall out of the window are forgotten
+	state.Advance("d", start.Add(syncOverlap+30*time.Second))
+	if got := recentKeys(state); !reflect.DeepEqual(got, map[string]bool{"b": true, "d": true}) {
+		t.Errorf("recent keys are %v", got)
+	}
+	if !state.Synced("a", start) {
+		t.Error("an object older than the window is not synced")
+	}
+
+	state.MarkAhead("e")
+	state.MarkAhead("e")
+	if !state.IsAhead("e") || len(state.Ahead) != 1 {
+		t.Errorf("ahead keys are %v", state.Ahead)
+	}
+	state.Advance("e", start.Add(syncOverlap+time.Minute))
+	if state.IsAhead("e") {
+		t.Error("an advanced key is still ahead")
+	}
+}
+
+func TestSaveSyncState(t *testing.T) {
+	store := openTestStore(t)
+	state, err := store.RetrieveSyncState("bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, SyncState{}) {
+		t.Errorf("state of a source never synced is %+v", state)
+	}
+
+	state.Advance("a", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	state.MarkAhead("b")
+	if err := store.SaveSyncState("bucket", state); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.RetrieveSyncState("bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.LastModified.Equal(state.LastModified) || !reflect.DeepEqual(recentKeys(saved), recentKeys(state)) || !reflect.DeepEqual(saved.Ahead, state.Ahead) {
+		t.Errorf("saved state is %+v, want %+v", saved, state)
+	}
+	if other, _ := store.RetrieveSyncState("other"); !reflect.DeepEqual(other, SyncState{}) {
+		t.Errorf("state of another source is %+v", other)
+	}
+
+	// Sources are not folders
+	assertFolders(t, store, "inbox", "sent", "trash")
+}
+
+// TestRetrieveLegacySyncState reads a state saved with the keys fetched at
+// exactly LastModified, as older versions kept it.
+func TestRetrieveLegacySyncState(t *testing.T) {
+	store := openTestStore(t)
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	value, _ := json.Marshal(map[string]interface{}{"lastModified": modified, "keys": []string{"a", "b"}})
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(syncStateBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("bucket"), value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := store.RetrieveSyncState("bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Keys) != 0 || !state.Synced("a", modified) || !state.Synced("b", modified) || state.Synced("c", modified) {
+		t.Errorf("legacy state read as %+v", state)
+	}
+}
+
+func recentKeys(state SyncState) map[string]bool {
+	keys := map[string]bool{}
+	for key := range state.Recent {
+		keys[key] = true
+	}
+	return keys
+}
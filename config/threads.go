@@ -0,0 +1,465 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Buckets of the conversation index, kept in the Store next to the folders.
+const (
+	// threadContainersBucket maps a Message-ID to its threadContainer.
+	threadContainersBucket = "thread_containers"
+	// threadsBucket maps a thread ID to its threadRecord.
+	threadsBucket = "threads"
+	// threadSubjectsBucket maps a normalized subject to the latest thread
+	// with that subject.
+	threadSubjectsBucket = "thread_subjects"
+)
+
+// ThreadMessage is what the conversation index needs to know about a stored
+// message.
+type ThreadMessage struct {
+	// Folder and Key locate the message in the store.
+	Folder string
+	Key    string
+	// MessageID, InReplyTo and References are message IDs without angle
+	// brackets. A message without a Message-ID is indexed under its folder
+	// and key.
+	MessageID  string
+	InReplyTo  string
+	References []string
+	Subject    string
+	Date       time.Time
+}
+
+// ThreadEntry is one stored message of a thread.
+type ThreadEntry struct {
+	MessageID string    `json:"messageId"`
+	Parent    string    `json:"parent,omitempty"`
+	Folder    string    `json:"folder"`
+	Key       string    `json:"key"`
+	Date      time.Time `json:"date"`
+}
+
+// Thread is a conversation with its stored messages ordered by date. Its
+// subject is the subject of the oldest message.
+type Thread struct {
+	ID       string        `json:"id"`
+	Subject  string        `json:"subject"`
+	Latest   time.Time     `json:"latest"`
+	Messages []ThreadEntry `json:"messages"`
+}
+
+// threadContainer is a node of the JWZ threading tree. Containers of messages
+// that have only been referenced, and are not stored, have no Folder.
+type threadContainer struct {
+	Thread  string    `json:"thread"`
+	Parent  string    `json:"parent,omitempty"`
+	Folder  string    `json:"folder,omitempty"`
+	Key     string    `json:"key,omitempty"`
+	Subject string    `json:"subject,omitempty"`
+	Date    time.Time `json:"date"`
+}
+
+type threadRecord struct {
+	Subject string    `json:"subject"`
+	Latest  time.Time `json:"latest"`
+	Members []string  `json:"members"`
+}
+
+// IndexThread adds a stored message to the conversation index. The message
+// joins the thread of any message it references or that references it, in
+// the manner of JWZ threading, merging threads the message links together.
+// A reply that references nothing known joins the latest thread with the
+// same subject.
+func (s *Store) IndexThread(msg ThreadMessage) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return indexThread(tx, msg)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index thread: %v", err)
+	}
+	return nil
+}
+
+// RebuildThreads replaces the conversation index with one built from msgs.
+func (s *Store) RebuildThreads(msgs []ThreadMessage) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{threadContainersBucket, threadsBucket, threadSubjectsBucket} {
+			if err := tx.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		for _, msg := range msgs {
+			if err := indexThread(tx, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rebuild threads: %v", err)
+	}
+	return nil
+}
+
+// RetrieveThreads returns every thread with at least one stored message
+// outside the trash, most recently active first. Trashed messages stay in
+// the index, so they rejoin their thread if restored, but are left out.
+func (s *Store) RetrieveThreads() ([]Thread, error) {
+	var threads []Thread
+	err := s.db.View(func(tx *bolt.Tx) error {
+		threadBucket := tx.Bucket([]byte(threadsBucket))
+		containers := tx.Bucket([]byte(threadContainersBucket))
+		if threadBucket == nil || containers == nil {
+			return nil
+		}
+
+		return threadBucket.ForEach(func(k, v []byte) error {
+			var record threadRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+
+			thread := Thread{ID: string(k), Subject: record.Subject}
+			var oldest *threadContainer
+			for _, member := range record.Members {
+				container, err := getContainer(containers, member)
+				if err != nil {
+					return err
+				}
+				if container == nil || container.Folder == "" || container.Folder == FolderTrash {
+					continue
+				}
+				if oldest == nil || container.Date.Before(oldest.Date) {
+					oldest = container
+				}
+				if container.Date.After(thread.Latest) {
+					thread.Latest = container.Date
+				}
+				thread.Messages = append(thread.Messages, ThreadEntry{
+					MessageID: member,
+					Parent:    container.Parent,
+					Folder:    container.Folder,
+					Key:       container.Key,
+					Date:      container.Date,
+				})
+			}
+			if len(thread.Messages) == 0 {
+				return nil
+			}
+			if oldest.Subject != "" {
+				thread.Subject = oldest.Subject
+			}
+
+			sort.SliceStable(thread.Messages, func(i, j int) bool {
+				return thread.Messages[i].Date.Before(thread.Messages[j].Date)
+			})
+			threads = append(threads, thread)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve threads: %v", err)
+	}
+
+	sort.SliceStable(threads, func(i, j int) bool {
+		return threads[i].Latest.After(threads[j].Latest)
+	})
+	return threads, nil
+}
+
+// LookupMessage returns the folder and key of the stored message with the
+// given Message-ID, or empty strings if the conversation index has none.
+func (s *Store) LookupMessage(messageID string) (string, string, error) {
+	var folder, key string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		containers := tx.Bucket([]byte(threadContainersBucket))
+		if containers == nil {
+			return nil
+		}
+		container, err := getContainer(containers, messageID)
+		if err != nil || container == nil {
+			return err
+		}
+		folder, key = container.Folder, container.Key
+		return nil
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to look up message: %v", err)
+	}
+	return folder, key, nil
+}
+
+func indexThread(tx *bolt.Tx, msg ThreadMessage) error {
+	containers, err := tx.CreateBucketIfNotExists([]byte(threadContainersBucket))
+	if err != nil {
+		return err
+	}
+	threadBucket, err := tx.CreateBucketIfNotExists([]byte(threadsBucket))
+	if err != nil {
+		return err
+	}
+	subjects, err := tx.CreateBucketIfNotExists([]byte(threadSubjectsBucket))
+	if err != nil {
+		return err
+	}
+
+	messageID := msg.MessageID
+	if messageID == "" {
+		messageID = msg.Folder + "/" + msg.Key
+	}
+
+	// The reference chain, oldest first, ending with the direct parent
+	references := append([]string{}, msg.References...)
+	if msg.InReplyTo != "" && (len(references) == 0 || references[len(references)-1] != msg.InReplyTo) {
+		references = append(references, msg.InReplyTo)
+	}
+	references = removeID(references, messageID)
+
+	// Find the threads this message links together
+	var linked []string
+	for _, id := range append([]string{messageID}, references...) {
+		container, err := getContainer(containers, id)
+		if err != nil {
+			return err
+		}
+		if container != nil && !containsID(linked, container.Thread) {
+			linked = append(linked, container.Thread)
+		}
+	}
+
+	subject := NormalizeSubject(msg.Subject)
+	if len(linked) == 0 && subject != "" && isReplySubject(msg.Subject) {
+		if thread := subjects.Get([]byte(subject)); thread != nil && threadBucket.Get(thread) != nil {
+			linked = append(linked, string(thread))
+		}
+	}
+
+	threadID := messageID
+	if len(linked) > 0 {
+		threadID = linked[0]
+	}
+	record, err := getThread(threadBucket, threadID)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		record = &threadRecord{Subject: msg.Subject}
+	}
+	if len(linked) > 1 {
+		for _, other := range linked[1:] {
+			if err := mergeThread(containers, threadBucket, subjects, record, threadID, other); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Link the reference chain, keeping parents that are already known
+	parent := ""
+	for _, id := range references {
+		container, err := getContainer(containers, id)
+		if err != nil {
+			return err
+		}
+		if container == nil {
+			container = &threadContainer{}
+		}
+		if container.Parent == "" && parent != "" {
+			loops, err := isAncestor(containers, id, parent)
+			if err != nil {
+				return err
+			}
+			if !loops {
+				container.Parent = parent
+			}
+		}
+		container.Thread = threadID
+		if err := putContainer(containers, id, container); err != nil {
+			return err
+		}
+		record.Members = appendID(record.Members, id)
+		parent = id
+	}
+
+	container, err := getContainer(containers, messageID)
+	if err != nil {
+		return err
+	}
+	if container == nil {
+		container = &threadContainer{}
+	}
+	container.Thread = threadID
+	container.Folder = msg.Folder
+	container.Key = msg.Key
+	container.Subject = msg.Subject
+	container.Date = msg.Date
+	if parent != "" {
+		loops, err := isAncestor(containers, messageID, parent)
+		if err != nil {
+			return err
+		}
+		if !loops {
+			container.Parent = parent
+		}
+	}
+	if err := putContainer(containers, messageID, container); err != nil {
+		return err
+	}
+	record.Members = appendID(record.Members, messageID)
+
+	if record.Latest.IsZero() || msg.Date.After(record.Latest) {
+		record.Latest = msg.Date
+	}
+	if record.Subject == "" {
+		record.Subject = msg.Subject
+	}
+	if err := putJSON(threadBucket, threadID, record); err != nil {
+		return err
+	}
+	if subject != "" {
+		return subjects.Put([]byte(subject), []byte(threadID))
+	}
+	return nil
+}
+
+// mergeThread moves the messages of thread other into record, the thread
+// threadID.
+func mergeThread(containers, threadBucket, subjects *bolt.Bucket, record *threadRecord, threadID, other string) error {
+	otherRecord, err := getThread(threadBucket, other)
+	if err != nil || otherRecord == nil {
+		return err
+	}
+
+	for _, member := range otherRecord.Members {
+		container, err := getContainer(containers, member)
+		if err != nil {
+			return err
+		}
+		if container == nil {
+			continue
+		}
+		container.Thread = threadID
+		if err := putContainer(containers, member, container); err != nil {
+			return err
+		}
+		record.Members = appendID(record.Members, member)
+	}
+	if otherRecord.Latest.After(record.Latest) {
+		record.Latest = otherRecord.Latest
+	}
+
+	subject := []byte(NormalizeSubject(otherRecord.Subject))
+	if len(subject) > 0 && string(subjects.Get(subject)) == other {
+		if err := subjects.Put(subject, []byte(threadID)); err != nil {
+			return err
+		}
+	}
+	return threadBucket.Delete([]byte(other))
+}
+
+// isAncestor reports whether id is id itself or one of the ancestors of
+// child, in which case making id the parent of child would create a loop.
+func isAncestor(containers *bolt.Bucket, child, id string) (bool, error) {
+	for steps := 0; id != "" && steps < 1000; steps++ {
+		if id == child {
+			return true, nil
+		}
+		container, err := getContainer(containers, id)
+		if err != nil || container == nil {
+			return false, err
+		}
+		id = container.Parent
+	}
+	return false, nil
+}
+
+var subjectPrefixRegex = regexp.MustCompile(`(?i)^\s*((re|fwd?|aw|sv|wg)(\[\d+\])?\s*:\s*|\[[^\]]*\]\s*)`)
+
+// NormalizeSubject strips reply and forward prefixes and mailing list tags
+// from a subject and lowercases it, so that every message of a conversation
+// has the same normalized subject.
+func NormalizeSubject(subject string) string {
+	for {
+		stripped := subjectPrefixRegex.ReplaceAllString(subject, "")
+		if stripped == subject {
+			break
+		}
+		subject = stripped
+	}
+	return strings.ToLower(strings.Join(strings.Fields(subject), " "))
+}
+
+var replyPrefixRegex = regexp.MustCompile(`(?i)^\s*(\[[^\]]*\]\s*)*(re|aw|sv)(\[\d+\])?\s*:`)
+
+func isReplySubject(subject string) bool {
+	return replyPrefixRegex.MatchString(subject)
+}
+
+func getContainer(bucket *bolt.Bucket, id string) (*threadContainer, error) {
+	value := bucket.Get([]byte(id))
+	if value == nil {
+		return nil, nil
+	}
+	var container threadContainer
+	if err := json.Unmarshal(value, &container); err != nil {
+		return nil, err
+	}
+	return &container, nil
+}
+
+func putContainer(bucket *bolt.Bucket, id string, container *threadContainer) error {
+	return putJSON(bucket, id, container)
+}
+
+func getThread(bucket *bolt.Bucket, id string) (*threadRecord, error) {
+	value := bucket.Get([]byte(id))
+	if value == nil {
+		return nil, nil
+	}
+	var record threadRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func putJSON(bucket *bolt.Bucket, key string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), encoded)
+}
+
+func containsID(ids []string, id string) bool {
+	for _, existing := range ids {
+		if existing == id {
+			return true
+		}
+	}
+	return false
+}
+
+func appendID(ids []string, id string) []string {
+	if containsID(ids, id) {
+		return ids
+	}
+	return append(ids, id)
+}
+
+func removeID(ids []string, id string) []string {
+	kept := ids[:0]
+	for _, existing := range ids {
+		if existing != id {
+			kept = append(kept, existing)
+		}
+	}
+	return kept
+}
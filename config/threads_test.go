@@ -0,0 +1,128 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThreads(t *testing.T) {
+	store := openTestStore(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := store.CreateFolder("work"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := []ThreadMessage{
+		{Folder: FolderInbox, Key: "k1", MessageID: "a@x", Subject: "Plans", Date: start},
+		{Folder: FolderSent, Key: "k2", MessageID: "b@x", InReplyTo: "a@x", Subject: "Re: Plans", Date: start.Add(time.Hour)},
+		// Refers to a@x through a message that is not stored
+		{Folder: FolderInbox, Key: "k3", MessageID: "d@x", References: []string{"a@x", "c@x"}, Subject: "Re: Plans", Date: start.Add(3 * time.Hour)},
+		// Joins by subject, having lost its references
+		{Folder: FolderInbox, Key: "k4", MessageID: "e@x", Subject: "RE: [list] plans", Date: start.Add(4 * time.Hour)},
+		// A new subject starts a thread, and so does one that is not a reply
+		{Folder: FolderInbox, Key: "k5", MessageID: "f@x", Subject: "Lunch", Date: start.Add(2 * time.Hour)},
+		{Folder: FolderInbox, Key: "k6", MessageID: "g@x", Subject: "Plans", Date: start.Add(5 * time.Hour)},
+		// Without a Message-ID a message is indexed under its location
+		{Folder: FolderInbox, Key: "k7", Subject: "No ID", Date: start.Add(30 * time.Minute)},
+	}
+	for _, msg := range msgs {
+		if err := store.IndexThread(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertThreads(t, store, "Plans: g@x", "Plans: a@x,b@x,d@x,e@x", "Lunch: f@x", "No ID: inbox/k7")
+
+	threads, err := store.RetrieveThreads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range threads[1].Messages {
+		if entry.MessageID == "d@x" && entry.Parent != "c@x" {
+			t.Errorf("d@x has parent %q, want c@x", entry.Parent)
+		}
+	}
+
+	// A message linking two threads merges them
+	link := ThreadMessage{Folder: FolderInbox, Key: "k8", MessageID: "h@x", References: []string{"f@x", "g@x"}, Subject: "Re: Lunch", Date: start.Add(6 * time.Hour)}
+	if err := store.IndexThread(link); err != nil {
+		t.Fatal(err)
+	}
+	assertThreads(t, store, "Lunch: f@x,g@x,h@x", "Plans: a@x,b@x,d@x,e@x", "No ID: inbox/k7")
+
+	// Moving a message moves its entry; deleting it drops the entry
+	saveTestEmail(t, store, FolderInbox, "k1", start)
+	if err := store.MoveEmails(FolderInbox, "work", []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+	if folder, key, err := store.LookupMessage("a@x"); err != nil || folder != "work" || key != "k1" {
+		t.Errorf("LookupMessage(a@x) = %q, %q, %v", folder, key, err)
+	}
+	if folder, key, err := store.LookupMessage("c@x"); err != nil || folder != "" || key != "" {
+		t.Errorf("LookupMessage of a message that is not stored = %q, %q, %v", folder, key, err)
+	}
+
+	// Trashed messages are left out until they are restored
+	if err := store.DeleteEmails("work", []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+	assertThreads(t, store, "Lunch: f@x,g@x,h@x", "Re: Plans: b@x,d@x,e@x", "No ID: inbox/k7")
+	if err := store.MoveEmails(FolderTrash, FolderInbox, []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+	assertThreads(t, store, "Lunch: f@x,g@x,h@x", "Plans: a@x,b@x,d@x,e@x", "No ID: inbox/k7")
+	if err := store.DeleteEmails(FolderInbox, []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteEmails(FolderTrash, []string{"k1"}); err != nil {
+		t.Fatal(err)
+	}
+	assertThreads(t, store, "Lunch: f@x,g@x,h@x", "Re: Plans: b@x,d@x,e@x", "No ID: inbox/k7")
+
+	// A thread is as recent as the newest message it shows
+	saveTestEmail(t, store, FolderInbox, "k6", start)
+	saveTestEmail(t, store, FolderInbox, "k8", start)
+	if err := store.DeleteEmails(FolderInbox, []string{"k6", "k8"}); err != nil {
+		t.Fatal(err)
+	}
+	assertThreads(t, store, "Re: Plans: b@x,d@x,e@x", "Lunch: f@x", "No ID: inbox/k7")
+
+	if err := store.RebuildThreads(msgs[4:5]); err != nil {
+		t.Fatal(err)
+	}
+	assertThreads(t, store, "Lunch: f@x")
+}
+
+func TestNormalizeSubject(t *testing.T) {
+	for subject, want := range map[string]string{
+		"Re: Plans":                 "plans",
+		"RE: Fwd: [team] Plans ":    "plans",
+		"Re[2]:  Quarterly  Report": "quarterly report",
+		"AW: SV: Plans":             "plans",
+		"Plans: Re: next week":      "plans: re: next week",
+	} {
+		if got := NormalizeSubject(subject); got != want {
+			t.Errorf("NormalizeSubject(%q) = %q, want %q", subject, got, want)
+		}
+	}
+}
+
+// assertThreads checks the threads, most recently active first, each as its
+// subject and the message IDs of its stored messages in date order.
+func assertThreads(t *testing.T, store *Store, want ...string) {
+	t.Helper()
+	threads, err := store.RetrieveThreads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, thread := range threads {
+		var ids []string
+		for _, entry := range thread.Messages {
+			ids = append(ids, entry.MessageID)
+		}
+		got = append(got, thread.Subject+": "+strings.Join(ids, ","))
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("threads are\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Outbound transport types.
+const (
+	TransportSES  = "ses"
+	TransportSMTP = "smtp"
+	TransportFile = "file"
+)
+
+// TransportSettings configures how mail from one sending identity is delivered.
+type TransportSettings struct {
+	// Type is TransportSES, TransportSMTP or TransportFile.
+	Type string `json:"type"`
+
+	// SMTP submission server. Port 465 uses implicit TLS; any other port
+	// upgrades with STARTTLS when the server offers it.
+	Host     string `json:"host,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Dir is where TransportFile writes .eml files.
+	Dir string `json:"dir,omitempty"`
+}
+
+// transportKey is the config key holding the settings for identity. The
+// settings under the bare "Transport" key apply to every identity without
+// its own entry.
+func transportKey(identity string) string {
+	if identity == "" {
+		return "Transport"
+	}
+	return "Transport " + identity
+}
+
+// ReadTransportSettings returns the transport configured for the sending
+// identity, falling back to the default transport and then to SES.
+func ReadTransportSettings(identity string) (TransportSettings, error) {
+	for _, key := range []string{transportKey(identity), transportKey("")} {
+		value, err := ReadKeyFromFile(ConfigFile, key)
+		if err != nil || value == "" {
+			continue
+		}
+
+		var settings TransportSettings
+		if err := json.Unmarshal([]byte(value), &settings); err != nil {
+			return TransportSettings{}, fmt.Errorf("invalid transport settings under %q: %v", key, err)
+		}
+		return settings, nil
+	}
+
+	return TransportSettings{Type: TransportSES}, nil
+}
+
+// WriteTransportSettings saves the transport for the sending identity. An
+// empty identity sets the default transport.
+func WriteTransportSettings(identity string, settings TransportSettings) error {
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return WriteKeyToFile(transportKey(identity), string(value), ConfigFile)
+}
@@ -0,0 +1,359 @@
+package emailparser
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// OutgoingEmail is a message to be rendered by BuildMIMEMessage.
+type OutgoingEmail struct {
+	From        string
+	To          []string
+	Cc          []string
+	Bcc         []string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []OutgoingAttachment
+	// MessageID is used without angle brackets. BuildMIMEMessage generates
+	// one if it is empty.
+	MessageID string
+	// Date defaults to the current time.
+	Date time.Time
+	// InReplyTo and References thread a reply or forward; message IDs are
+	// used without angle brackets.
+	InReplyTo  string
+	References []string
+}
+
+// OutgoingAttachment is a file attached to an OutgoingEmail, given either by
+// its path on disk or by its content. Filename and ContentType are filled in
+// from the path and the content when they are empty. A file with a ContentID
+// is sent inline for cid: URLs in the HTML body.
+type OutgoingAttachment struct {
+	Path        string `json:"path,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	ContentID   string `json:"contentId,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+}
+
+// load reads the attachment from Path if no content was given and detects
+// its MIME type.
+func (a *OutgoingAttachment) load() error {
+	if a.Data == nil && a.Path != "" {
+		data, err := os.ReadFile(a.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read attachment: %v", err)
+		}
+		a.Data = data
+	}
+	if a.Filename == "" {
+		a.Filename = filepath.Base(a.Path)
+	}
+	if a.Filename == "" || a.Filename == "." {
+		a.Filename = "attachment"
+	}
+	if a.ContentType == "" {
+		a.ContentType = mime.TypeByExtension(filepath.Ext(a.Filename))
+	}
+	if a.ContentType == "" {
+		a.ContentType = http.DetectContentType(a.Data)
+	}
+	return nil
+}
+
+// Recipients returns every envelope recipient of the message.
+func (e *OutgoingEmail) Recipients() []string {
+	var recipients []string
+	recipients = append(recipients, e.To...)
+	recipients = append(recipients, e.Cc...)
+	recipients = append(recipients, e.Bcc...)
+	return recipients
+}
+
+// BuildMIMEMessage renders email as an RFC 5322 message with CRLF line
+// endings. Bcc recipients are left out of the headers. The readable body is
+// quoted-printable text, or a multipart/alternative of text and HTML; the
+// text is derived from the HTML if Text is empty. With attachments the body
+// and the base64 encoded files are wrapped in a multipart/mixed. It fills in
+// MessageID and Date on email if they were not set.
+func BuildMIMEMessage(email *OutgoingEmail) ([]byte, error) {
+	if email.MessageID == "" {
+		email.MessageID = NewMessageID(email.From)
+	}
+	if email.Date.IsZero() {
+		email.Date = time.Now()
+	}
+	text := email.Text
+	if text == "" {
+		text = HTMLToText(email.HTML)
+	}
+
+	from, err := formatAddressList([]string{email.From})
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender: %v", err)
+	}
+	to, err := formatAddressList(email.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient: %v", err)
+	}
+	cc, err := formatAddressList(email.Cc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cc address: %v", err)
+	}
+
+	var b bytes.Buffer
+
+	// Write headers
+	writeHeader(&b, "MIME-Version", "1.0")
+	writeHeader(&b, "From", from)
+	writeHeader(&b, "Date", email.Date.Format(time.RFC1123Z))
+	writeHeader(&b, "Message-ID", "<"+email.MessageID+">")
+	writeHeader(&b, "Subject", mime.QEncoding.Encode("utf-8", email.Subject))
+	if to != "" {
+		writeHeader(&b, "To", to)
+	}
+	if cc != "" {
+		writeHeader(&b, "Cc", cc)
+	}
+	if email.InReplyTo != "" {
+		writeHeader(&b, "In-Reply-To", "<"+email.InReplyTo+">")
+	}
+	if len(email.References) > 0 {
+		writeHeader(&b, "References", "<"+strings.Join(email.References, ">\r\n <")+">")
+	}
+
+	bodyHeader, body, err := buildTextBody(text, email.HTML)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(email.Attachments) == 0 {
+		writePartHeader(&b, bodyHeader)
+		b.WriteString("\r\n")
+		b.Write(body)
+		return b.Bytes(), nil
+	}
+
+	// Write the body followed by the attachments
+	var mixed bytes.Buffer
+	mw := multipart.NewWriter(&mixed)
+	w, err := mw.CreatePart(bodyHeader)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(body)
+
+	for i := range email.Attachments {
+		attachment := &email.Attachments[i]
+		if err := attachment.load(); err != nil {
+			return nil, err
+		}
+		disposition := "attachment"
+		header := textproto.MIMEHeader{
+			"Content-Type":              {attachmentContentType(attachment.ContentType, attachment.Filename)},
+			"Content-Transfer-Encoding": {"base64"},
+		}
+		if attachment.ContentID != "" {
+			disposition = "inline"
+			header.Set("Content-ID", "<"+attachment.ContentID+">")
+		}
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+		w, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64Lines(w, attachment.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	writeHeader(&b, "Content-Type", fmt.Sprintf(`multipart/mixed; boundary="%s"`, mw.Boundary()))
+	b.WriteString("\r\n")
+	b.Write(mixed.Bytes())
+
+	return b.Bytes(), nil
+}
+
+// buildTextBody returns the headers and content of the readable part of a
+// message: quoted-printable text, or text and HTML alternatives.
+func buildTextBody(text, htmlBody string) (textproto.MIMEHeader, []byte, error) {
+	var body bytes.Buffer
+
+	if htmlBody == "" {
+		if err := writeQuotedPrintable(&body, text); err != nil {
+			return nil, nil, err
+		}
+		return textproto.MIMEHeader{
+			"Content-Type":              {`text/plain; charset="UTF-8"`},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		}, body.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{`text/plain; charset="UTF-8"`, text},
+		{`text/html; charset="UTF-8"`, htmlBody},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := writeQuotedPrintable(w, part.content); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	return textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf(`multipart/alternative; boundary="%s"`, mw.Boundary())},
+	}, body.Bytes(), nil
+}
+
+// attachmentContentType adds the file name to a content type, which older
+// clients use instead of the Content-Disposition filename.
+func attachmentContentType(contentType, filename string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+	params["name"] = filename
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// SetMessageID replaces the Message-ID header of a message built by
+// BuildMIMEMessage. It is used when the sending service assigns its own ID.
+func SetMessageID(raw []byte, messageID string) []byte {
+	headerEnd := bytes.Index(raw, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return raw
+	}
+
+	lines := bytes.Split(raw[:headerEnd], []byte("\r\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(bytes.ToLower(line), []byte("message-id:")) {
+			lines[i] = []byte("Message-ID: <" + messageID + ">")
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write(bytes.Join(lines, []byte("\r\n")))
+	b.Write(raw[headerEnd:])
+	return b.Bytes()
+}
+
+// NewMessageID returns a unique Message-ID, without angle brackets, in the
+// sender's domain.
+func NewMessageID(sender string) string {
+	domain := "astromail.local"
+	if address, err := mail.ParseAddress(sender); err == nil {
+		sender = address.Address
+	}
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		domain = sender[at+1:]
+	}
+
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("%d.%s@%s", time.Now().UnixNano(), hex.EncodeToString(random), domain)
+}
+
+var (
+	blockTagRegex = regexp.MustCompile(`(?i)<\s*(br|/p|/div|/li|/tr|/h[1-6])\s*/?>`)
+	skipTagRegex  = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	tagRegex      = regexp.MustCompile(`<[^>]*>`)
+	blankRegex    = regexp.MustCompile(`\n{3,}`)
+)
+
+// HTMLToText strips tags from an HTML body, keeping line breaks for block
+// elements, and decodes entities.
+func HTMLToText(htmlBody string) string {
+	text := skipTagRegex.ReplaceAllString(htmlBody, "")
+	text = blockTagRegex.ReplaceAllString(text, "\n")
+	text = tagRegex.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = blankRegex.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
+
+// formatAddressList parses each address and joins them for a header,
+// encoding display names as needed.
+func formatAddressList(addresses []string) (string, error) {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if strings.TrimSpace(address) == "" {
+			continue
+		}
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return "", fmt.Errorf("%q: %v", address, err)
+		}
+		if parsed.Name == "" {
+			formatted = append(formatted, parsed.Address)
+		} else {
+			formatted = append(formatted, parsed.String())
+		}
+	}
+	return strings.Join(formatted, ", "), nil
+}
+
+func writeHeader(b *bytes.Buffer, key, value string) {
+	fmt.Fprintf(b, "%s: %s\r\n", key, value)
+}
+
+// writePartHeader writes the content headers of a part as message headers.
+func writePartHeader(b *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, key := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+		if value := header.Get(key); value != "" {
+			writeHeader(b, key, value)
+		}
+	}
+}
+
+// writeBase64Lines writes data base64 encoded in lines of 76 characters.
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := io.WriteString(w, encoded+"\r\n")
+	return err
+}
+
+// writeQuotedPrintable writes content quoted-printable encoded; line breaks
+// come out as CRLF.
+func writeQuotedPrintable(w io.Writer, content string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
@@ -0,0 +1,100 @@
+package emailparser
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// wordDecoder decodes RFC 2047 encoded words in any charset the body decoder
+// knows, not only UTF-8 and ISO-8859-1.
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// decodeTransferEncoding undoes a base64 or quoted-printable
+// Content-Transfer-Encoding. Content that does not decode cleanly is decoded
+// as far as possible, the way mail clients display broken messages, rather
+// than failing the whole message. multipart.Reader already decodes
+// quoted-printable parts and drops their header.
+func decodeTransferEncoding(encoding string, content []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return decodeBase64(content)
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(content)))
+		if err != nil && len(decoded) == 0 {
+			return content
+		}
+		return decoded
+	default:
+		return content
+	}
+}
+
+// decodeBase64 decodes base64 content, ignoring whitespace, missing padding
+// and anything after the first invalid character.
+func decodeBase64(content []byte) []byte {
+	stripped := bytes.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, content)
+	stripped = bytes.TrimRight(stripped, "=")
+
+	decoded := make([]byte, base64.RawStdEncoding.DecodedLen(len(stripped)))
+	n, err := base64.RawStdEncoding.Decode(decoded, stripped)
+	if err != nil {
+		if corrupt, ok := err.(base64.CorruptInputError); ok {
+			// Decode whole groups before the bad character
+			valid := int(corrupt) / 4 * 4
+			n, _ = base64.RawStdEncoding.Decode(decoded, stripped[:valid])
+		}
+	}
+	return decoded[:n]
+}
+
+// decodeCharset converts text in the declared charset to UTF-8. Text without
+// a charset, or in one that is not known, is assumed to be UTF-8, and
+// invalid sequences are replaced. Labels are resolved the way browsers do, so
+// ISO-8859-1 is read as its Windows-1252 superset and GB2312 as GBK.
+func decodeCharset(content []byte, charset string) string {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return toValidUTF8(content)
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return toValidUTF8(content)
+	}
+	decoded, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return toValidUTF8(content)
+	}
+	return string(decoded)
+}
+
+func toValidUTF8(content []byte) string {
+	if utf8.Valid(content) {
+		return string(content)
+	}
+	return strings.ToValidUTF8(string(content), "�")
+}
+
+// charsetReader is the mime.WordDecoder hook for charsets other than UTF-8,
+// US-ASCII and ISO-8859-1.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
@@ -1,196 +1,166 @@
 package emailparser
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"io"
-	"mime"
-	"mime/multipart"
 	"net/mail"
+	"net/textproto"
 	"strings"
 	"time"
 )
 
+// Email is a parsed message.
 type Email struct {
-	From        string       `json:"from"`
-	Subject     string       `json:"subject"`
-	To          []string     `json:"to"`
+	// MessageID is the Message-ID header without angle brackets.
+	MessageID string `json:"messageId"`
+	// InReplyTo and References hold message IDs without angle brackets,
+	// References oldest first.
+	InReplyTo  string          `json:"inReplyTo,omitempty"`
+	References []string        `json:"references,omitempty"`
+	From       *mail.Address   `json:"from"`
+	To         []*mail.Address `json:"to"`
+	Cc         []*mail.Address `json:"cc,omitempty"`
+	Bcc        []*mail.Address `json:"bcc,omitempty"`
+	ReplyTo    []*mail.Address `json:"replyTo,omitempty"`
+	Subject    string          `json:"subject"`
+	// Date is the zero time if the Date header is missing or unreadable.
+	Date time.Time `json:"date"`
+	// Size is the size of the raw message in bytes.
+	Size        int          `json:"size"`
 	Text        string       `json:"text"`
 	HTML        string       `json:"html"`
-	Date        string       `json:"date"`
 	Attachments []Attachment `json:"attachments,omitempty"`
+	// Parts is the root of the message's MIME tree.
+	Parts Part `json:"parts"`
 }
 
+// Attachment is a file part of a message, or a forwarded message. Inline
+// parts referenced from the HTML body by cid: URLs have Inline set.
 type Attachment struct {
 	Filename    string `json:"filename"`
 	ContentType string `json:"contentType"`
-	Content     string `json:"content"`
+	ContentID   string `json:"contentId,omitempty"`
+	Inline      bool   `json:"inline,omitempty"`
+	Size        int    `json:"size"`
+	// Content is the decoded file, base64 encoded.
+	Content string `json:"content"`
+	// nested is set on files inside a forwarded message, which are part of
+	// that message's attachment too.
+	nested bool
 }
 
-func ParseEmail(emailStr string) (string, error) {
+// ParseEmail parses a raw RFC 5322 message. Only a message whose header
+// cannot be read is an error; unreadable addresses and dates are kept as
+// well as they can be, and a body with broken MIME structure is decoded as
+// far as it goes.
+func ParseEmail(emailStr string) (*Email, error) {
 	msg, err := mail.ReadMessage(strings.NewReader(emailStr))
 	if err != nil {
-		return "", fmt.Errorf("error reading message: %v", err)
+		return nil, fmt.Errorf("error reading message: %v", err)
 	}
 
-	// Parse subject and from
-	subject := msg.Header.Get("Subject")
-	from := msg.Header.Get("From")
-	date := msg.Header.Get("Date")
 	// Decode RFC 2047 encoded strings if necessary
-	dec := new(mime.WordDecoder)
-	subject, err = dec.DecodeHeader(subject)
+	subject, err := wordDecoder.DecodeHeader(msg.Header.Get("Subject"))
 	if err != nil {
-		fmt.Printf("Failed to decode subject: %v\n", err)
-	}
-	from, err = dec.DecodeHeader(from)
-	if err != nil {
-		fmt.Printf("Failed to decode from: %v\n", err)
+		subject = msg.Header.Get("Subject")
 	}
 
-	// Parse recipients
-	var to []string
-	for _, addr := range msg.Header["To"] {
-		to = append(to, addr)
+	email := &Email{
+		MessageID:  firstMessageID(msg.Header.Get("Message-ID")),
+		InReplyTo:  firstMessageID(msg.Header.Get("In-Reply-To")),
+		References: ParseMessageIDs(msg.Header.Get("References")),
+		To:         parseAddressList(msg.Header, "To"),
+		Cc:         parseAddressList(msg.Header, "Cc"),
+		Bcc:        parseAddressList(msg.Header, "Bcc"),
+		ReplyTo:    parseAddressList(msg.Header, "Reply-To"),
+		Subject:    subject,
+		Size:       len(emailStr),
 	}
-
-	var text, html string
-
-	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
-	if err != nil {
-		return "", fmt.Errorf("error parsing media type: %v", err)
+	if from := parseAddressList(msg.Header, "From"); len(from) > 0 {
+		email.From = from[0]
+	}
+	if date, err := mail.ParseDate(msg.Header.Get("Date")); err == nil {
+		email.Date = date
 	}
 
-	if strings.HasPrefix(mediaType, "multipart/") {
-		mr := multipart.NewReader(msg.Body, params["boundary"])
-		for {
-			part, err := mr.NextPart()
-			if err != nil {
-				break
-			}
+	email.Parts = walkPart(textproto.MIMEHeader(msg.Header), msg.Body, email, false, 0)
 
-			partMediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
-			if err != nil {
-				fmt.Printf("Error parsing part media type: %v\n", err)
-				continue
-			}
+	return email, nil
+}
 
-			partBody, err := io.ReadAll(part)
-			if err != nil {
-				fmt.Printf("Error reading part body: %v\n", err)
-				continue
-			}
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
 
-			switch partMediaType {
-			case "text/plain":
-				text = string(partBody)
-			case "text/html":
-				html = string(partBody)
+// parseAddressList parses every address in the header fields named key. A
+// field that is not a valid address list is kept whole as a single address,
+// so a malformed sender still shows up.
+func parseAddressList(header mail.Header, key string) []*mail.Address {
+	var addresses []*mail.Address
+	for _, value := range header[textproto.CanonicalMIMEHeaderKey(key)] {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		parsed, err := addressParser.ParseList(value)
+		if err != nil {
+			decoded, decodeErr := wordDecoder.DecodeHeader(value)
+			if decodeErr != nil {
+				decoded = value
 			}
+			parsed = []*mail.Address{looseAddress(decoded)}
 		}
-	} else {
-		// Handle non-multipart emails here if needed
+		addresses = append(addresses, parsed...)
 	}
+	return addresses
+}
 
-	email := Email{
-		From:    from,
-		Subject: subject,
-		To:      to,
-		Text:    text,
-		HTML:    html,
-		Date:    date,
+// looseAddress reads an address that net/mail rejects, such as the
+// "user@example.com <user@example.com>" sender of mail saved by older
+// versions of AstroMail, taking whatever is in angle brackets as the address.
+func looseAddress(value string) *mail.Address {
+	value = strings.TrimSpace(value)
+	start, end := strings.LastIndex(value, "<"), strings.LastIndex(value, ">")
+	if start < 0 || end < start {
+		return &mail.Address{Address: value}
 	}
-
-	jsonEmail, err := json.MarshalIndent(email, "", "  ")
-	if err != nil {
-		return "", fmt.Errorf("error marshalling to JSON: %v", err)
+	address := &mail.Address{
+		Name:    strings.Trim(strings.TrimSpace(value[:start]), `"`),
+		Address: strings.TrimSpace(value[start+1 : end]),
 	}
-
-	return string(jsonEmail), nil
+	if address.Name == address.Address {
+		address.Name = ""
+	}
+	return address
 }
 
-func parseParts(reader *multipart.Reader, email *Email) error {
+// ParseMessageIDs returns the message IDs in a Message-ID, In-Reply-To or
+// References header, without angle brackets. Text outside angle brackets,
+// such as the comments some clients put in In-Reply-To, is ignored; a header
+// with no angle brackets at all is taken as a single bare ID.
+func ParseMessageIDs(value string) []string {
+	var ids []string
 	for {
-		part, err := reader.NextPart()
-		if err == io.EOF {
+		start := strings.Index(value, "<")
+		if start < 0 {
 			break
-		} else if err != nil {
-			return fmt.Errorf("error reading part: %v", err)
 		}
-
-		contentType := part.Header.Get("Content-Type")
-		contentTransferEncoding := part.Header.Get("Content-Transfer-Encoding")
-
-		body, err := io.ReadAll(part)
-		if err != nil {
-			return fmt.Errorf("error reading part body: %v", err)
+		end := strings.Index(value[start:], ">")
+		if end < 0 {
+			break
 		}
-
-		switch {
-		case strings.HasPrefix(contentType, "text/plain"):
-			email.Text += string(body)
-
-		case strings.HasPrefix(contentType, "text/html"):
-			email.HTML += string(body)
-
-		case strings.Contains(contentType, "attachment") || strings.Contains(part.Header.Get("Content-Disposition"), "attachment"):
-			filename := part.FileName()
-			var content string
-			switch contentTransferEncoding {
-			case "base64":
-				content = base64.StdEncoding.EncodeToString(body)
-			default:
-				content = string(body)
-			}
-
-			email.Attachments = append(email.Attachments, Attachment{
-				Filename:    filename,
-				ContentType: contentType,
-				Content:     content,
-			})
+		if id := strings.TrimSpace(value[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
 		}
-
-		// Check for nested multipart parts
-		// if strings.HasPrefix(contentType, "multipart/") {
-		// 	nestedMr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
-		// 	if err := parseParts(nestedMr, email); err != nil {
-		// 		return err
-		// 	}
-		// }
+		value = value[start+end+1:]
 	}
-	return nil
+	if ids == nil {
+		if id := strings.TrimSpace(value); id != "" && !strings.ContainsAny(id, " \t") {
+			ids = append(ids, id)
+		}
+	}
+	return ids
 }
 
-// CreateEMLString creates an email EML string with the given parameters.
-func CreateEMLString(sender, subject, body string, recipient, ccAddresses []string, messageId string) string {
-	var b strings.Builder
-
-	// Get current date and time in the desired format
-	now := time.Now().Format(time.RFC1123Z)
-
-	// Write headers
-	fmt.Fprintf(&b, "MIME-Version: 1.0\n")
-	fmt.Fprintf(&b, "From: %s <%s>\n", sender, sender)
-	fmt.Fprintf(&b, "Date: %s\n", now)
-	fmt.Fprintf(&b, "Message-ID: <%s@mail.gmail.com>\n", messageId)
-	fmt.Fprintf(&b, "Subject: %s\n", subject)
-	fmt.Fprintf(&b, "To: %s\n", strings.Join(recipient, ", "))
-	if len(ccAddresses) > 0 {
-		fmt.Fprintf(&b, "Cc: %s\n", strings.Join(ccAddresses, ", "))
+func firstMessageID(value string) string {
+	if ids := ParseMessageIDs(value); len(ids) > 0 {
+		return ids[0]
 	}
-	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=\"000000000000f0dd9b06111072ad\"\n\n")
-
-	// Write body parts
-	fmt.Fprintf(&b, "--000000000000f0dd9b06111072ad\n")
-	fmt.Fprintf(&b, "Content-Type: text/plain; charset=\"UTF-8\"\n\n")
-	fmt.Fprintf(&b, "%s\n", body)
-
-	fmt.Fprintf(&b, "--000000000000f0dd9b06111072ad\n")
-	fmt.Fprintf(&b, "Content-Type: text/html; charset=\"UTF-8\"\n\n")
-	fmt.Fprintf(&b, "%s\n", body)
-
-	fmt.Fprintf(&b, "--000000000000f0dd9b06111072ad--\n")
-
-	return b.String()
+	return ""
 }
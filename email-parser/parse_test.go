@@ -0,0 +1,59 @@
+package emailparser
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestParseEmailGolden parses every testdata/*.eml and compares the result,
+// as indented JSON, with the .golden file next to it. Run with -update to
+// write the golden files after an intended change.
+func TestParseEmailGolden(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures in testdata")
+	}
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".eml")
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			email, err := ParseEmail(string(raw))
+			if err != nil {
+				t.Fatalf("ParseEmail: %v", err)
+			}
+			got, err := json.MarshalIndent(email, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := strings.TrimSuffix(fixture, ".eml") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("ParseEmail(%s) differs from %s:\ngot:\n%s\nwant:\n%s", fixture, golden, got, want)
+			}
+		})
+	}
+}
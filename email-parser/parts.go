@@ -0,0 +1,146 @@
+package emailparser
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Part is one node of a message's MIME tree. Multipart parts list their
+// children in Parts; a message/rfc822 part has the forwarded message's root
+// part as its only child.
+type Part struct {
+	ContentType string `json:"contentType"`
+	Disposition string `json:"disposition,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	ContentID   string `json:"contentId,omitempty"`
+	// Subject is set on message/rfc822 parts.
+	Subject string `json:"subject,omitempty"`
+	// Size is the decoded size of a leaf part in bytes.
+	Size  int    `json:"size"`
+	Parts []Part `json:"parts,omitempty"`
+}
+
+// maxPartDepth bounds the nesting of multipart and message/rfc822 parts.
+const maxPartDepth = 32
+
+// walkPart parses the part with the given header and body, appending its
+// readable text to email and its files to email.Attachments, and returns its
+// node of the part tree. Parts inside a forwarded message only go into the
+// tree and the attachments, so they do not mix with the body of email.
+// Broken structure, such as a truncated message or a multipart without a
+// boundary, keeps whatever was decoded before it; a multipart that yields no
+// parts at all is shown as plain text.
+func walkPart(header textproto.MIMEHeader, body io.Reader, email *Email, forwarded bool, depth int) Part {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 default for a missing or broken Content-Type
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	part := Part{ContentType: mediaType, ContentID: strings.Trim(header.Get("Content-ID"), "<>")}
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	part.Disposition = disposition
+	part.Filename = dispositionParams["filename"]
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	if decoded, err := wordDecoder.DecodeHeader(part.Filename); err == nil {
+		part.Filename = decoded
+	}
+
+	// A truncated body still has its first bytes
+	raw, _ := io.ReadAll(body)
+
+	if strings.HasPrefix(mediaType, "multipart/") && depth < maxPartDepth {
+		if params["boundary"] != "" {
+			mr := multipart.NewReader(bytes.NewReader(raw), params["boundary"])
+			for {
+				child, err := mr.NextPart()
+				if err != nil {
+					break
+				}
+				part.Parts = append(part.Parts, walkPart(child.Header, child, email, forwarded, depth+1))
+			}
+		}
+		if len(part.Parts) > 0 {
+			return part
+		}
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	content := decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), raw)
+	part.Size = len(content)
+
+	if mediaType == "message/rfc822" {
+		nested, err := mail.ReadMessage(bytes.NewReader(content))
+		if err != nil {
+			// Keep it as a file the user can still open
+			email.Attachments = append(email.Attachments, newAttachment(part, content, forwarded))
+			return part
+		}
+		subject, _ := wordDecoder.DecodeHeader(nested.Header.Get("Subject"))
+		part.Subject = subject
+		if part.Filename == "" {
+			part.Filename = forwardedFilename(subject)
+		}
+		email.Attachments = append(email.Attachments, newAttachment(part, content, forwarded))
+		if depth < maxPartDepth {
+			part.Parts = []Part{walkPart(textproto.MIMEHeader(nested.Header), nested.Body, email, true, depth+1)}
+		}
+		return part
+	}
+
+	isBody := part.Disposition != "attachment" && part.Filename == "" &&
+		(mediaType == "text/plain" || mediaType == "text/html")
+	switch {
+	case isBody && forwarded:
+		// Readable only through the forwarded message's attachment
+	case isBody && mediaType == "text/plain":
+		email.Text = joinBody(email.Text, decodeCharset(content, params["charset"]))
+	case isBody && mediaType == "text/html":
+		email.HTML = joinBody(email.HTML, decodeCharset(content, params["charset"]))
+	default:
+		email.Attachments = append(email.Attachments, newAttachment(part, content, forwarded))
+	}
+	return part
+}
+
+func newAttachment(part Part, content []byte, forwarded bool) Attachment {
+	return Attachment{
+		Filename:    part.Filename,
+		ContentType: part.ContentType,
+		ContentID:   part.ContentID,
+		Inline:      part.Disposition != "attachment" && part.ContentID != "",
+		Size:        len(content),
+		Content:     base64.StdEncoding.EncodeToString(content),
+		nested:      forwarded,
+	}
+}
+
+// joinBody appends another inline text part, as sent by clients that put
+// text between attachments in a multipart/mixed.
+func joinBody(body, content string) string {
+	if body == "" {
+		return content
+	}
+	return body + "\n" + content
+}
+
+func forwardedFilename(subject string) string {
+	if subject == "" {
+		return "forwarded.eml"
+	}
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, subject)
+	return name + ".eml"
+}
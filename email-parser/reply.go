@@ -0,0 +1,220 @@
+package emailparser
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+var (
+	replyPrefixRegex   = regexp.MustCompile(`(?i)^\s*(re|aw|sv)(\[\d+\])?\s*:`)
+	forwardPrefixRegex = regexp.MustCompile(`(?i)^\s*(fwd?|wg)\s*:`)
+)
+
+// ReplySubject prefixes subject with "Re:" unless it already is a reply.
+func ReplySubject(subject string) string {
+	if replyPrefixRegex.MatchString(subject) {
+		return subject
+	}
+	return "Re: " + subject
+}
+
+// ForwardSubject prefixes subject with "Fwd:" unless it already is a forward.
+func ForwardSubject(subject string) string {
+	if forwardPrefixRegex.MatchString(subject) {
+		return subject
+	}
+	return "Fwd: " + subject
+}
+
+// BuildReply builds a reply from self to original with body, an HTML
+// fragment like the one Send_Email takes, followed by the quoted original.
+// The reply goes to the original's Reply-To or sender, or back to its
+// recipients when self sent it. With all set the other recipients of the
+// original are added, leaving out self.
+func BuildReply(original *Email, self, body string, all bool) *OutgoingEmail {
+	selfAddress := addressOf(self)
+
+	var to, cc []*mail.Address
+	switch {
+	case original.From != nil && sameAddress(original.From.Address, selfAddress):
+		to = original.To
+		if all {
+			cc = original.Cc
+		}
+	case len(original.ReplyTo) > 0:
+		to = original.ReplyTo
+	case original.From != nil:
+		to = []*mail.Address{original.From}
+	}
+	if all && (original.From == nil || !sameAddress(original.From.Address, selfAddress)) {
+		to = append(append([]*mail.Address{}, to...), original.To...)
+		cc = original.Cc
+	}
+
+	seen := map[string]bool{selfAddress: true}
+	email := &OutgoingEmail{
+		From:       self,
+		To:         uniqueAddresses(to, seen),
+		Cc:         uniqueAddresses(cc, seen),
+		Subject:    ReplySubject(original.Subject),
+		InReplyTo:  original.MessageID,
+		References: referencesFor(original),
+	}
+
+	attribution := fmt.Sprintf("On %s, %s wrote:", formatQuoteDate(original), formatAddress(original.From))
+	email.Text = HTMLToText(body) + "\n\n" + attribution + "\n" + quoteText(originalText(original))
+	email.HTML = body + `<br><br><div class="astromail_quote">` + html.EscapeString(attribution) +
+		`<br><blockquote style="margin:0 0 0 .8ex;border-left:1px solid #ccc;padding-left:1ex">` +
+		originalHTML(original) + `</blockquote></div>`
+	return email
+}
+
+// BuildForward builds a forward of original from self to the given
+// recipients with body, an HTML fragment, followed by the original message.
+// The original's own attachments are carried over with their Content-ID, so
+// cid: images in the quoted HTML still show; files inside a message it
+// forwarded travel in that message's attachment.
+func BuildForward(original *Email, self string, to []string, body string) (*OutgoingEmail, error) {
+	email := &OutgoingEmail{
+		From:       self,
+		To:         to,
+		Subject:    ForwardSubject(original.Subject),
+		References: referencesFor(original),
+	}
+
+	headers := [][2]string{
+		{"From", formatAddress(original.From)},
+		{"Date", formatQuoteDate(original)},
+		{"Subject", original.Subject},
+		{"To", formatAddresses(original.To)},
+	}
+	if len(original.Cc) > 0 {
+		headers = append(headers, [2]string{"Cc", formatAddresses(original.Cc)})
+	}
+
+	var text, htmlHeader strings.Builder
+	text.WriteString("---------- Forwarded message ---------\n")
+	htmlHeader.WriteString("---------- Forwarded message ---------<br>")
+	for _, header := range headers {
+		fmt.Fprintf(&text, "%s: %s\n", header[0], header[1])
+		fmt.Fprintf(&htmlHeader, "%s: %s<br>", header[0], html.EscapeString(header[1]))
+	}
+
+	email.Text = HTMLToText(body) + "\n\n" + text.String() + "\n" + originalText(original)
+	email.HTML = body + `<br><br><div class="astromail_quote">` + htmlHeader.String() + "<br>" +
+		originalHTML(original) + `</div>`
+
+	for _, attachment := range original.Attachments {
+		if attachment.nested {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(attachment.Content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode attachment %s: %v", attachment.Filename, err)
+		}
+		email.Attachments = append(email.Attachments, OutgoingAttachment{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			ContentID:   attachment.ContentID,
+			Data:        data,
+		})
+	}
+	return email, nil
+}
+
+// referencesFor returns the References of a message replying to or
+// forwarding original.
+func referencesFor(original *Email) []string {
+	references := append([]string{}, original.References...)
+	if len(references) == 0 && original.InReplyTo != "" {
+		references = append(references, original.InReplyTo)
+	}
+	if original.MessageID != "" {
+		references = append(references, original.MessageID)
+	}
+	return references
+}
+
+func originalText(original *Email) string {
+	if original.Text != "" {
+		return original.Text
+	}
+	return HTMLToText(original.HTML)
+}
+
+func originalHTML(original *Email) string {
+	if original.HTML != "" {
+		return original.HTML
+	}
+	return strings.ReplaceAll(html.EscapeString(original.Text), "\n", "<br>")
+}
+
+// quoteText prefixes every line of text with "> ".
+func quoteText(text string) string {
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ">") {
+			lines[i] = ">" + line
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatQuoteDate(original *Email) string {
+	if original.Date.IsZero() {
+		return "an unknown date"
+	}
+	return original.Date.Format("Mon, Jan 2, 2006 at 3:04 PM")
+}
+
+func formatAddress(address *mail.Address) string {
+	if address == nil {
+		return "unknown sender"
+	}
+	if address.Name == "" {
+		return address.Address
+	}
+	return fmt.Sprintf("%s <%s>", address.Name, address.Address)
+}
+
+func formatAddresses(addresses []*mail.Address) string {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		formatted = append(formatted, formatAddress(address))
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// uniqueAddresses formats addresses for an OutgoingEmail, skipping the ones
+// in seen and adding the rest to it.
+func uniqueAddresses(addresses []*mail.Address, seen map[string]bool) []string {
+	var unique []string
+	for _, address := range addresses {
+		key := strings.ToLower(address.Address)
+		if address.Address == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, address.String())
+	}
+	return unique
+}
+
+// addressOf returns the lowercased bare address of an address that may have
+// a display name.
+func addressOf(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		address = parsed.Address
+	}
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+func sameAddress(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
@@ -22,6 +22,14 @@ export function parseEmailAndName(input) {
     return { name, email };
 }
 
+// Formats a mail.Address as returned by the Go side for display
+export function formatAddress(address) {
+    if (!address) {
+      return '';
+    }
+    return address.Name ? `${address.Name} <${address.Address}>` : address.Address;
+}
+
 export function previewString(str, numChars) {
     // Check if the string's length is greater than the specified number of characters
     if (str.length > numChars) {
@@ -1,14 +1,82 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
+import {smtpstack} from '../models';
+import {config} from '../models';
+import {emailparser} from '../models';
+import {main} from '../models';
 
-export function Get_Items(arg1:string,arg2:number):Promise<Array<string>>;
+export function Add_Labels(arg1:string,arg2:Array<string>,arg3:Array<string>):Promise<void>;
 
-export function Get_Sent():Promise<Array<string>>;
+export function Check_DNS():Promise<Array<smtpstack.RecordCheck>>;
+
+export function Choose_Attachments():Promise<Array<string>>;
+
+export function Clear_Flags(arg1:string,arg2:Array<string>,arg3:Array<string>):Promise<void>;
+
+export function Configure_AWS(arg1:string,arg2:string,arg3:string):Promise<void>;
+
+export function Configure_Transport(arg1:string,arg2:config.TransportSettings):Promise<void>;
+
+export function Copy_Emails(arg1:string,arg2:string,arg3:Array<string>):Promise<void>;
+
+export function Create_Folder(arg1:string):Promise<void>;
+
+export function Create_Label(arg1:string):Promise<void>;
+
+export function Delete_Emails(arg1:string,arg2:Array<string>):Promise<void>;
+
+export function Delete_Folder(arg1:string):Promise<void>;
+
+export function Delete_Label(arg1:string):Promise<void>;
+
+export function Empty_Trash():Promise<void>;
+
+export function Export_DNS_Records(arg1:string):Promise<string>;
+
+export function Forward_Email(arg1:string,arg2:string,arg3:string,arg4:Array<emailparser.OutgoingAttachment>):Promise<void>;
+
+export function Get_Attachment(arg1:string,arg2:string,arg3:number):Promise<string>;
+
+export function Get_DNS_Records():Promise<Array<smtpstack.DNSRecord>>;
+
+export function Get_Folder_Counts():Promise<{[key: string]: config.FolderCounts}>;
+
+export function Get_Folders():Promise<Array<config.Folder>>;
+
+export function Get_Items(arg1:string,arg2:string,arg3:boolean):Promise<main.MailPage>;
+
+export function Get_Label(arg1:string):Promise<Array<main.MailItem>>;
+
+export function Get_Labels():Promise<Array<config.Label>>;
+
+export function Get_Sent():Promise<main.MailPage>;
+
+export function Get_Threads():Promise<Array<main.Conversation>>;
 
 export function Is_Setup():Promise<boolean>;
 
-export function Launch_Smtp_Server(arg1:string,arg2:string,arg3:string,arg4:string):Promise<void>;
+export function Launch_Smtp_Server(arg1:string,arg2:string,arg3:string,arg4:string,arg5:string,arg6:boolean):Promise<void>;
+
+export function Move_Emails(arg1:string,arg2:string,arg3:Array<string>):Promise<void>;
+
+export function Rebuild_Search_Index():Promise<void>;
+
+export function Rebuild_Threads():Promise<void>;
 
 export function Refresh_Inbox():Promise<void>;
 
-export function Send_Email(arg1:string,arg2:string,arg3:string):Promise<void>;
+export function Remove_Labels(arg1:string,arg2:Array<string>,arg3:Array<string>):Promise<void>;
+
+export function Rename_Folder(arg1:string,arg2:string):Promise<void>;
+
+export function Rename_Label(arg1:string,arg2:string):Promise<void>;
+
+export function Reply_Email(arg1:string,arg2:string,arg3:boolean,arg4:Array<emailparser.OutgoingAttachment>):Promise<void>;
+
+export function Search(arg1:string,arg2:string):Promise<main.SearchPage>;
+
+export function Send_Email(arg1:string,arg2:string,arg3:string,arg4:Array<emailparser.OutgoingAttachment>):Promise<void>;
+
+export function Set_Flags(arg1:string,arg2:Array<string>,arg3:Array<string>):Promise<void>;
+
+export function Teardown_Smtp_Server(arg1:string):Promise<void>;
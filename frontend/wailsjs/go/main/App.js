@@ -2,26 +2,154 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
-export function Get_Items(arg1, arg2) {
-  return window['go']['main']['App']['Get_Items'](arg1, arg2);
+export function Add_Labels(arg1, arg2, arg3) {
+  return window['go']['main']['App']['Add_Labels'](arg1, arg2, arg3);
+}
+
+export function Check_DNS() {
+  return window['go']['main']['App']['Check_DNS']();
+}
+
+export function Choose_Attachments() {
+  return window['go']['main']['App']['Choose_Attachments']();
+}
+
+export function Clear_Flags(arg1, arg2, arg3) {
+  return window['go']['main']['App']['Clear_Flags'](arg1, arg2, arg3);
+}
+
+export function Configure_AWS(arg1, arg2, arg3) {
+  return window['go']['main']['App']['Configure_AWS'](arg1, arg2, arg3);
+}
+
+export function Configure_Transport(arg1, arg2) {
+  return window['go']['main']['App']['Configure_Transport'](arg1, arg2);
+}
+
+export function Copy_Emails(arg1, arg2, arg3) {
+  return window['go']['main']['App']['Copy_Emails'](arg1, arg2, arg3);
+}
+
+export function Create_Folder(arg1) {
+  return window['go']['main']['App']['Create_Folder'](arg1);
+}
+
+export function Create_Label(arg1) {
+  return window['go']['main']['App']['Create_Label'](arg1);
+}
+
+export function Delete_Emails(arg1, arg2) {
+  return window['go']['main']['App']['Delete_Emails'](arg1, arg2);
+}
+
+export function Delete_Folder(arg1) {
+  return window['go']['main']['App']['Delete_Folder'](arg1);
+}
+
+export function Delete_Label(arg1) {
+  return window['go']['main']['App']['Delete_Label'](arg1);
+}
+
+export function Empty_Trash() {
+  return window['go']['main']['App']['Empty_Trash']();
+}
+
+export function Export_DNS_Records(arg1) {
+  return window['go']['main']['App']['Export_DNS_Records'](arg1);
+}
+
+export function Forward_Email(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['Forward_Email'](arg1, arg2, arg3, arg4);
+}
+
+export function Get_Attachment(arg1, arg2, arg3) {
+  return window['go']['main']['App']['Get_Attachment'](arg1, arg2, arg3);
+}
+
+export function Get_DNS_Records() {
+  return window['go']['main']['App']['Get_DNS_Records']();
+}
+
+export function Get_Folder_Counts() {
+  return window['go']['main']['App']['Get_Folder_Counts']();
+}
+
+export function Get_Folders() {
+  return window['go']['main']['App']['Get_Folders']();
+}
+
+export function Get_Items(arg1, arg2, arg3) {
+  return window['go']['main']['App']['Get_Items'](arg1, arg2, arg3);
+}
+
+export function Get_Label(arg1) {
+  return window['go']['main']['App']['Get_Label'](arg1);
+}
+
+export function Get_Labels() {
+  return window['go']['main']['App']['Get_Labels']();
 }
 
 export function Get_Sent() {
   return window['go']['main']['App']['Get_Sent']();
 }
 
+export function Get_Threads() {
+  return window['go']['main']['App']['Get_Threads']();
+}
+
 export function Is_Setup() {
   return window['go']['main']['App']['Is_Setup']();
 }
 
-export function Launch_Smtp_Server(arg1, arg2, arg3, arg4) {
-  return window['go']['main']['App']['Launch_Smtp_Server'](arg1, arg2, arg3, arg4);
+export function Launch_Smtp_Server(arg1, arg2, arg3, arg4, arg5, arg6) {
+  return window['go']['main']['App']['Launch_Smtp_Server'](arg1, arg2, arg3, arg4, arg5, arg6);
+}
+
+export function Move_Emails(arg1, arg2, arg3) {
+  return window['go']['main']['App']['Move_Emails'](arg1, arg2, arg3);
+}
+
+export function Rebuild_Search_Index() {
+  return window['go']['main']['App']['Rebuild_Search_Index']();
+}
+
+export function Rebuild_Threads() {
+  return window['go']['main']['App']['Rebuild_Threads']();
 }
 
 export function Refresh_Inbox() {
   return window['go']['main']['App']['Refresh_Inbox']();
 }
 
-export function Send_Email(arg1, arg2, arg3) {
-  return window['go']['main']['App']['Send_Email'](arg1, arg2, arg3);
+export function Remove_Labels(arg1, arg2, arg3) {
+  return window['go']['main']['App']['Remove_Labels'](arg1, arg2, arg3);
+}
+
+export function Rename_Folder(arg1, arg2) {
+  return window['go']['main']['App']['Rename_Folder'](arg1, arg2);
+}
+
+export function Rename_Label(arg1, arg2) {
+  return window['go']['main']['App']['Rename_Label'](arg1, arg2);
+}
+
+export function Reply_Email(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['Reply_Email'](arg1, arg2, arg3, arg4);
+}
+
+export function Search(arg1, arg2) {
+  return window['go']['main']['App']['Search'](arg1, arg2);
+}
+
+export function Send_Email(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['Send_Email'](arg1, arg2, arg3, arg4);
+}
+
+export function Set_Flags(arg1, arg2, arg3) {
+  return window['go']['main']['App']['Set_Flags'](arg1, arg2, arg3);
+}
+
+export function Teardown_Smtp_Server(arg1) {
+  return window['go']['main']['App']['Teardown_Smtp_Server'](arg1);
 }
@@ -0,0 +1,495 @@
+export namespace config {
+	
+	export class Folder {
+	    name: string;
+	    parent?: string;
+	    system: boolean;
+	    total: number;
+	    unread: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new Folder(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.name = source["name"];
+	        this.parent = source["parent"];
+	        this.system = source["system"];
+	        this.total = source["total"];
+	        this.unread = source["unread"];
+	    }
+	}
+	export class Label {
+	    name: string;
+	    count: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new Label(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.name = source["name"];
+	        this.count = source["count"];
+	    }
+	}
+	export class TransportSettings {
+	    type: string;
+	    host?: string;
+	    port?: number;
+	    username?: string;
+	    password?: string;
+	    dir?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new TransportSettings(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.type = source["type"];
+	        this.host = source["host"];
+	        this.port = source["port"];
+	        this.username = source["username"];
+	        this.password = source["password"];
+	        this.dir = source["dir"];
+	    }
+	}
+
+}
+
+export namespace emailparser {
+	
+	export class Attachment {
+	    filename: string;
+	    contentType: string;
+	    contentId?: string;
+	    inline?: boolean;
+	    size: number;
+	    content: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new Attachment(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.filename = source["filename"];
+	        this.contentType = source["contentType"];
+	        this.contentId = source["contentId"];
+	        this.inline = source["inline"];
+	        this.size = source["size"];
+	        this.content = source["content"];
+	    }
+	}
+	export class Part {
+	    contentType: string;
+	    disposition?: string;
+	    filename?: string;
+	    contentId?: string;
+	    subject?: string;
+	    size: number;
+	    parts?: Part[];
+	
+	    static createFrom(source: any = {}) {
+	        return new Part(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.contentType = source["contentType"];
+	        this.disposition = source["disposition"];
+	        this.filename = source["filename"];
+	        this.contentId = source["contentId"];
+	        this.subject = source["subject"];
+	        this.size = source["size"];
+	        this.parts = this.convertValues(source["parts"], Part);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class Email {
+	    messageId: string;
+	    inReplyTo?: string;
+	    references?: string[];
+	    // Go type: mail
+	    from?: any;
+	    to: mail.Address[];
+	    cc?: mail.Address[];
+	    bcc?: mail.Address[];
+	    replyTo?: mail.Address[];
+	    subject: string;
+	    // Go type: time
+	    date: any;
+	    size: number;
+	    text: string;
+	    html: string;
+	    attachments?: Attachment[];
+	    parts: Part;
+	
+	    static createFrom(source: any = {}) {
+	        return new Email(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.messageId = source["messageId"];
+	        this.inReplyTo = source["inReplyTo"];
+	        this.references = source["references"];
+	        this.from = this.convertValues(source["from"], null);
+	        this.to = this.convertValues(source["to"], mail.Address);
+	        this.cc = this.convertValues(source["cc"], mail.Address);
+	        this.bcc = this.convertValues(source["bcc"], mail.Address);
+	        this.replyTo = this.convertValues(source["replyTo"], mail.Address);
+	        this.subject = source["subject"];
+	        this.date = this.convertValues(source["date"], null);
+	        this.size = source["size"];
+	        this.text = source["text"];
+	        this.html = source["html"];
+	        this.attachments = this.convertValues(source["attachments"], Attachment);
+	        this.parts = this.convertValues(source["parts"], Part);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class OutgoingAttachment {
+	    path?: string;
+	    filename?: string;
+	    contentType?: string;
+	    contentId?: string;
+	    data?: number[];
+	
+	    static createFrom(source: any = {}) {
+	        return new OutgoingAttachment(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.path = source["path"];
+	        this.filename = source["filename"];
+	        this.contentType = source["contentType"];
+	        this.contentId = source["contentId"];
+	        this.data = source["data"];
+	    }
+	}
+
+}
+
+export namespace main {
+	
+	export class ConversationMessage {
+	    folder: string;
+	    key: string;
+	    parent?: string;
+	    email?: emailparser.Email;
+	
+	    static createFrom(source: any = {}) {
+	        return new ConversationMessage(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.folder = source["folder"];
+	        this.key = source["key"];
+	        this.parent = source["parent"];
+	        this.email = this.convertValues(source["email"], emailparser.Email);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class Conversation {
+	    id: string;
+	    subject: string;
+	    // Go type: time
+	    latest: any;
+	    messages: ConversationMessage[];
+	
+	    static createFrom(source: any = {}) {
+	        return new Conversation(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.subject = source["subject"];
+	        this.latest = this.convertValues(source["latest"], null);
+	        this.messages = this.convertValues(source["messages"], ConversationMessage);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	
+	export class MailItem {
+	    messageId: string;
+	    inReplyTo?: string;
+	    references?: string[];
+	    // Go type: mail
+	    from?: any;
+	    to: mail.Address[];
+	    cc?: mail.Address[];
+	    bcc?: mail.Address[];
+	    replyTo?: mail.Address[];
+	    subject: string;
+	    // Go type: time
+	    date: any;
+	    size: number;
+	    text: string;
+	    html: string;
+	    attachments?: emailparser.Attachment[];
+	    parts: emailparser.Part;
+	    folder: string;
+	    key: string;
+	    // Go type: time
+	    received: any;
+	    flags: string[];
+	    labels: string[];
+	    seen: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new MailItem(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.messageId = source["messageId"];
+	        this.inReplyTo = source["inReplyTo"];
+	        this.references = source["references"];
+	        this.from = this.convertValues(source["from"], null);
+	        this.to = this.convertValues(source["to"], mail.Address);
+	        this.cc = this.convertValues(source["cc"], mail.Address);
+	        this.bcc = this.convertValues(source["bcc"], mail.Address);
+	        this.replyTo = this.convertValues(source["replyTo"], mail.Address);
+	        this.subject = source["subject"];
+	        this.date = this.convertValues(source["date"], null);
+	        this.size = source["size"];
+	        this.text = source["text"];
+	        this.html = source["html"];
+	        this.attachments = this.convertValues(source["attachments"], emailparser.Attachment);
+	        this.parts = this.convertValues(source["parts"], emailparser.Part);
+	        this.folder = source["folder"];
+	        this.key = source["key"];
+	        this.received = this.convertValues(source["received"], null);
+	        this.flags = source["flags"];
+	        this.labels = source["labels"];
+	        this.seen = source["seen"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class MailPage {
+	    items: MailItem[];
+	    next: string;
+	    total: number;
+	    unread: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new MailPage(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.items = this.convertValues(source["items"], MailItem);
+	        this.next = source["next"];
+	        this.total = source["total"];
+	        this.unread = source["unread"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class SearchPage {
+	    items: MailItem[];
+	    next: string;
+	    total: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new SearchPage(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.items = this.convertValues(source["items"], MailItem);
+	        this.next = source["next"];
+	        this.total = source["total"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+
+}
+
+export namespace smtpstack {
+	
+	export class DNSRecord {
+	    purpose: string;
+	    name: string;
+	    type: string;
+	    value: string;
+	    priority?: number;
+	    ttl: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new DNSRecord(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.purpose = source["purpose"];
+	        this.name = source["name"];
+	        this.type = source["type"];
+	        this.value = source["value"];
+	        this.priority = source["priority"];
+	        this.ttl = source["ttl"];
+	    }
+	}
+	export class RecordCheck {
+	    record: DNSRecord;
+	    pass: boolean;
+	    found: string[];
+	    explanation: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new RecordCheck(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.record = this.convertValues(source["record"], DNSRecord);
+	        this.pass = source["pass"];
+	        this.found = source["found"];
+	        this.explanation = source["explanation"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+
+}
+
@@ -26,7 +26,8 @@ func main() {
 			Assets: assets,
 		},
 		//BackgroundColour: &options.RGBA{R: 27, G: 38, B: 54, A: 19},
-		OnStartup: app.startup,
+		OnStartup:  app.startup,
+		OnShutdown: app.shutdown,
 		Windows: &windows.Options{
 			WebviewIsTransparent: false,
 			WindowIsTranslucent:  false,
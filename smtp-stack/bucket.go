@@ -1,17 +1,17 @@
 package smtpstack
 
 import (
+	storage "AstroMail/config"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"regexp"
-	"sort"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 // MakeAWSS3BucketNameCompliant makes a string compliant with AWS S3 bucket naming rules
@@ -42,23 +42,32 @@ func makeAWSS3BucketNameCompliant(input string) string {
 func CreateEmailBucket(domain string) (string, error) {
 	bucketName := makeAWSS3BucketNameCompliant(fmt.Sprintf("AstroMail-%s", domain))
 
-	sdkConfig, err := config.LoadDefaultConfig(context.TODO(), config.WithSharedConfigProfile("AstroMailApp"), config.WithRegion("us-east-1"))
+	s3Client, err := newS3Client(context.TODO())
 	if err != nil {
-		return "", fmt.Errorf("failed to load AWS config: %w", err)
+		return "", err
 	}
 
-	fmt.Println(sdkConfig, err, bucketName)
-
-	s3Client := s3.NewFromConfig(sdkConfig)
+	fmt.Println("Creating bucket", bucketName)
 
 	createBucketParams := &s3.CreateBucketInput{
 		Bucket: aws.String(bucketName),
 	}
+	// us-east-1 is the default location and must not be given as a constraint.
+	if region := storage.AWSRegion(); region != "us-east-1" {
+		createBucketParams.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(region),
+		}
+	}
 
+	// A resumed setup finds the bucket it created last time
 	_, err = s3Client.CreateBucket(context.TODO(), createBucketParams)
+	var owned *types.BucketAlreadyOwnedByYou
+	if errors.As(err, &owned) {
+		fmt.Println("Bucket already exists", bucketName)
+		err = nil
+	}
 	if err != nil {
-		fmt.Printf("failed to create bucket: %s", err)
-		return "", err
+		return "", fmt.Errorf("failed to create bucket: %w", err)
 	}
 
 	// Add S3 bucket policy
@@ -81,8 +90,7 @@ func CreateEmailBucket(domain string) (string, error) {
 		Policy: aws.String(policy),
 	})
 	if err != nil {
-		fmt.Printf("failed to set bucket policy: %s", err)
-		return "", err
+		return "", fmt.Errorf("failed to set bucket policy: %w", err)
 	}
 
 	// Start a goroutine to check for bucket existence
@@ -137,69 +145,12 @@ func waitForBucketExistence(s3Client *s3.Client, bucketName string) (string, err
 	}
 }
 
-// ReadBucketFolderContent retrieves the 50 most recently updated objects in an S3 bucket folder.
-func ReadBucketFolderContent(bucketName, folderName string, pageNum int) ([]string, error) {
-	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithSharedConfigProfile("AstroMailApp"), config.WithRegion("us-east-1"))
-	if err != nil {
-		return nil, err
-	}
-
-	client := s3.NewFromConfig(cfg)
-
-	input := &s3.ListObjectsV2Input{
-		Bucket:     &bucketName,
-		Prefix:     &folderName,
-		StartAfter: nil,
-	}
-
-	if pageNum > 1 {
-		input.ContinuationToken = &folderName
-	}
-
-	result, err := client.ListObjectsV2(context.Background(), input)
-	if err != nil {
-		return nil, err
-	}
-
-	objects := make([]string, 0, len(result.Contents))
-	for _, obj := range result.Contents {
-		objects = append(objects, *obj.Key)
-	}
-
-	sort.Slice(objects, func(i, j int) bool {
-		return result.Contents[i].LastModified.After(*result.Contents[j].LastModified)
-	})
-
-	if len(objects) > pageNum*50 {
-		return objects[(pageNum-1)*50 : pageNum*50], nil
-	}
-
-	return objects[(pageNum-1)*50:], nil
-}
-
 // GetObjectContentAsString retrieves the content of an object in an S3 bucket as a string.
 func GetObjectContentAsString(bucketName, objectKey string) (string, error) {
-	cfg, err := config.LoadDefaultConfig(context.Background())
+	client, err := newS3Client(context.Background())
 	if err != nil {
 		return "", err
 	}
-
-	client := s3.NewFromConfig(cfg)
-
-	input := &s3.GetObjectInput{
-		Bucket: &bucketName,
-		Key:    &objectKey,
-	}
-
-	result, err := client.GetObject(context.Background(), input)
-	if err != nil {
-		return "", err
-	}
-
-	content, err := io.ReadAll(result.Body)
-	if err != nil {
-		return "", err
-	}
-
-	return string(content), nil
+	fetched := getObjectContent(context.Background(), client, bucketName, objectKey)
+	return fetched.content, fetched.err
 }
@@ -0,0 +1,132 @@
+package smtpstack
+
+import (
+	storage "AstroMail/config"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// SESInboundRegions lists the regions where SES can receive email.
+var SESInboundRegions = []string{
+	"us-east-1",
+	"us-east-2",
+	"us-west-2",
+	"ca-central-1",
+	"eu-west-1",
+	"eu-west-2",
+	"eu-central-1",
+	"ap-northeast-1",
+	"ap-southeast-1",
+	"ap-southeast-2",
+}
+
+// ValidateRegion returns an error if SES cannot receive email in region.
+func ValidateRegion(region string) error {
+	for _, inbound := range SESInboundRegions {
+		if region == inbound {
+			return nil
+		}
+	}
+	return fmt.Errorf("SES does not receive email in region %s; use one of %s", region, strings.Join(SESInboundRegions, ", "))
+}
+
+// LoadAWSConfig loads the AWS configuration every smtp-stack client is built
+// from, using the region, credentials and endpoint saved in AstroMail's
+// config. Static credentials, when set, take the place of the shared
+// credentials profile so local stand-ins like LocalStack need no AWS account.
+func LoadAWSConfig(ctx context.Context) (aws.Config, error) {
+	region := storage.AWSRegion()
+	if err := ValidateRegion(region); err != nil {
+		return aws.Config{}, err
+	}
+
+	options := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if accessKeyID, secretAccessKey := storage.AWSStaticCredentials(); accessKeyID != "" && secretAccessKey != "" {
+		options = append(options, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, ""),
+		))
+	} else {
+		options = append(options, config.WithSharedConfigProfile(storage.AWSProfile()))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load SDK configuration: %v", err)
+	}
+
+	if endpoint := storage.AWSEndpoint(); endpoint != "" {
+		cfg.BaseEndpoint = aws.String(endpoint)
+	}
+
+	return cfg, nil
+}
+
+// s3FromConfig creates an S3 client that honours the S3 endpoint and
+// path-style settings.
+func s3FromConfig(cfg aws.Config) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint := storage.S3Endpoint(); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = storage.S3PathStyle()
+	})
+}
+
+// sesFromConfig creates an SES client that honours the SES endpoint setting.
+func sesFromConfig(cfg aws.Config) *ses.Client {
+	return ses.NewFromConfig(cfg, func(o *ses.Options) {
+		if endpoint := storage.SESEndpoint(); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+}
+
+func newS3Client(ctx context.Context) (*s3.Client, error) {
+	cfg, err := LoadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s3FromConfig(cfg), nil
+}
+
+func newSESClient(ctx context.Context) (*ses.Client, error) {
+	cfg, err := LoadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sesFromConfig(cfg), nil
+}
+
+func newIAMClient(ctx context.Context) (*iam.Client, error) {
+	cfg, err := LoadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return iam.NewFromConfig(cfg), nil
+}
+
+func newSNSClient(ctx context.Context) (*sns.Client, error) {
+	cfg, err := LoadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sns.NewFromConfig(cfg), nil
+}
+
+func newSQSClient(ctx context.Context) (*sqs.Client, error) {
+	cfg, err := LoadAWSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sqs.NewFromConfig(cfg), nil
+}
@@ -0,0 +1,293 @@
+package smtpstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go"
+)
+
+// Teardown steps, in the order Deprovision runs them.
+const (
+	StepExport         = "Export"
+	StepRestoreRuleSet = "RestoreRuleSet"
+	StepDeleteRules    = "DeleteReceiptRules"
+	StepDeleteNotify   = "DeleteNotifications"
+	StepDeleteRole     = "DeleteRole"
+	StepDeleteBucket   = "DeleteBucket"
+	StepDeleteIdentity = "DeleteIdentity"
+)
+
+// DeprovisionOptions controls what Deprovision does besides removing resources.
+type DeprovisionOptions struct {
+	// ExportDir, if set, is a local directory every object in the email
+	// bucket is downloaded to before the bucket is deleted.
+	ExportDir string
+}
+
+// Deprovision removes the AWS stack Provision created, in dependency order:
+// the receipt rule set is deactivated (restoring whichever set was active
+// before AstroMail) and deleted, or only AstroMail's rule is removed if it was
+// merged into someone else's set, then the SNS topic and SQS queue, the IAM
+// role, the email bucket and the SES domain identity. Resources that are already gone are skipped, so a
+// failed teardown can be run again. On success the setup state is cleared
+// from the config file. progress may be nil.
+func Deprovision(ctx context.Context, opts DeprovisionOptions, progress func(ProvisionProgress)) error {
+	if progress == nil {
+		progress = func(ProvisionProgress) {}
+	}
+
+	cfg, err := LoadAWSConfig(ctx)
+	if err != nil {
+		return err
+	}
+	s3Client := s3FromConfig(cfg)
+	sesClient := sesFromConfig(cfg)
+	iamClient := iam.NewFromConfig(cfg)
+	snsClient := sns.NewFromConfig(cfg)
+	sqsClient := sqs.NewFromConfig(cfg)
+
+	bucket := readState(keyBucket)
+	domain := readState(keyDomain)
+
+	steps := []struct {
+		name string
+		skip bool
+		run  func() error
+	}{
+		{
+			name: StepExport,
+			skip: opts.ExportDir == "" || bucket == "",
+			run:  func() error { return exportBucket(ctx, s3Client, bucket, opts.ExportDir) },
+		},
+		{
+			name: StepRestoreRuleSet,
+			run:  func() error { return restoreReceiptRuleSet(ctx, sesClient, readState(keyPreviousRuleSet)) },
+		},
+		{
+			name: StepDeleteRules,
+			run:  func() error { return deleteReceiptRules(ctx, sesClient, readState(keyReceiptRuleSet)) },
+		},
+		{
+			name: StepDeleteNotify,
+			run: func() error {
+				return deleteMailNotifications(ctx, snsClient, sqsClient, MailNotifications{
+					TopicArn:        readState(keyTopicArn),
+					QueueURL:        readState(keyQueueURL),
+					SubscriptionArn: readState(keySubscriptionArn),
+				})
+			},
+		},
+		{
+			name: StepDeleteRole,
+			run:  func() error { return deleteForwardingRole(ctx, iamClient) },
+		},
+		{
+			name: StepDeleteBucket,
+			skip: bucket == "",
+			run:  func() error { return deleteBucket(ctx, s3Client, bucket) },
+		},
+		{
+			name: StepDeleteIdentity,
+			skip: domain == "",
+			run: func() error {
+				_, err := sesClient.DeleteIdentity(ctx, &ses.DeleteIdentityInput{Identity: aws.String(domain)})
+				return err
+			},
+		},
+	}
+
+	for _, step := range steps {
+		if step.skip {
+			progress(ProvisionProgress{Step: step.name, Status: StepSkipped})
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		progress(ProvisionProgress{Step: step.name, Status: StepRunning})
+		if err := step.run(); err != nil {
+			progress(ProvisionProgress{Step: step.name, Status: StepFailed, Detail: err.Error()})
+			return fmt.Errorf("teardown step %s failed: %w", step.name, err)
+		}
+		progress(ProvisionProgress{Step: step.name, Status: StepDone})
+	}
+
+	return resetProvisionState()
+}
+
+// exportBucket downloads every object in bucket to dir, keeping the key as
+// the relative path. Objects in Glacier cannot be downloaded without a
+// restore and are skipped; they were only archived once saved locally.
+func exportBucket(ctx context.Context, client *s3.Client, bucket, dir string) error {
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			if isNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to list bucket %s: %v", bucket, err)
+		}
+
+		for _, obj := range page.Contents {
+			if obj.StorageClass == s3types.ObjectStorageClassGlacier || obj.StorageClass == s3types.ObjectStorageClassDeepArchive {
+				fmt.Println("Skipping export of archived object in Glacier: ", aws.ToString(obj.Key))
+				continue
+			}
+			if err := exportObject(ctx, client, bucket, aws.ToString(obj.Key), dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func exportObject(ctx context.Context, client *s3.Client, bucket, key, dir string) error {
+	path := filepath.Join(dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	result, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", key, err)
+	}
+	defer result.Body.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, result.Body)
+	return err
+}
+
+// restoreReceiptRuleSet makes previous the active rule set again, or leaves no
+// rule set active if there was none before AstroMail. It does nothing if the
+// active set is not AstroMail's.
+func restoreReceiptRuleSet(ctx context.Context, client *ses.Client, previous string) error {
+	active, err := client.DescribeActiveReceiptRuleSet(ctx, &ses.DescribeActiveReceiptRuleSetInput{})
+	if err != nil {
+		return fmt.Errorf("failed to describe active receipt rule set: %v", err)
+	}
+	if active.Metadata == nil || aws.ToString(active.Metadata.Name) != receiptRuleSetName {
+		return nil
+	}
+
+	input := &ses.SetActiveReceiptRuleSetInput{}
+	if previous != "" {
+		input.RuleSetName = aws.String(previous)
+	}
+	if _, err := client.SetActiveReceiptRuleSet(ctx, input); err != nil {
+		return fmt.Errorf("failed to restore receipt rule set %q: %v", previous, err)
+	}
+	return nil
+}
+
+// deleteReceiptRules removes AstroMail's rule from ruleSet. The rule set
+// itself is only deleted if it is AstroMail's own; a rule set AstroMail merged
+// into is left in place.
+func deleteReceiptRules(ctx context.Context, client *ses.Client, ruleSet string) error {
+	if ruleSet == "" {
+		ruleSet = receiptRuleSetName
+	}
+
+	_, err := client.DeleteReceiptRule(ctx, &ses.DeleteReceiptRuleInput{
+		RuleName:    aws.String(receiptRuleName),
+		RuleSetName: aws.String(ruleSet),
+	})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete receipt rule: %v", err)
+	}
+	if ruleSet != receiptRuleSetName {
+		return nil
+	}
+
+	_, err = client.DeleteReceiptRuleSet(ctx, &ses.DeleteReceiptRuleSetInput{
+		RuleSetName: aws.String(receiptRuleSetName),
+	})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete receipt rule set: %v", err)
+	}
+	return nil
+}
+
+func deleteForwardingRole(ctx context.Context, client *iam.Client) error {
+	_, err := client.DeleteRolePolicy(ctx, &iam.DeleteRolePolicyInput{
+		PolicyName: aws.String(forwardingPolicyName),
+		RoleName:   aws.String(forwardingRoleName),
+	})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete role policy: %v", err)
+	}
+
+	_, err = client.DeleteRole(ctx, &iam.DeleteRoleInput{RoleName: aws.String(forwardingRoleName)})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete IAM role: %v", err)
+	}
+	return nil
+}
+
+// deleteBucket empties bucket and deletes it.
+func deleteBucket(ctx context.Context, client *s3.Client, bucket string) error {
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			if isNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to list bucket %s: %v", bucket, err)
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+
+		objects := make([]s3types.ObjectIdentifier, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			objects = append(objects, s3types.ObjectIdentifier{Key: obj.Key})
+		}
+		_, err = client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to empty bucket %s: %v", bucket, err)
+		}
+	}
+
+	_, err := client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete bucket %s: %v", bucket, err)
+	}
+	return nil
+}
+
+// isNotFound reports whether err is an AWS error saying the resource does not exist.
+func isNotFound(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "NoSuchBucket", "NoSuchEntity", "RuleDoesNotExist", "RuleSetDoesNotExist", "NotFound", "NoSuchLifecycleConfiguration",
+		"AWS.SimpleQueueService.NonExistentQueue", "QueueDoesNotExist":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package smtpstack
+
+import (
+	storage "AstroMail/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+)
+
+// Purposes of the records returned by BuildDNSRecords.
+const (
+	RecordVerification = "Verification"
+	RecordDKIM         = "DKIM"
+	RecordMX           = "MX"
+	RecordSPF          = "SPF"
+	RecordDMARC        = "DMARC"
+)
+
+// dnsRecordTTL is the TTL suggested for every generated record.
+const dnsRecordTTL = 1800
+
+// DNSRecord is a DNS record the user has to publish for their domain.
+type DNSRecord struct {
+	Purpose  string `json:"purpose"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Priority int    `json:"priority,omitempty"`
+	TTL      int    `json:"ttl"`
+}
+
+// DomainDNSRecords returns every record needed to receive and send mail for
+// domain through SES in the configured region, with the verification and
+// Easy DKIM tokens SES has for the identity. It only reads from SES; the
+// tokens are created by Provision.
+func DomainDNSRecords(domain string) ([]DNSRecord, error) {
+	client, err := newSESClient(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	verification, err := client.GetIdentityVerificationAttributes(context.TODO(), &ses.GetIdentityVerificationAttributesInput{
+		Identities: []string{domain},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get identity verification attributes for domain %s: %v", domain, err)
+	}
+	verificationToken := aws.ToString(verification.VerificationAttributes[domain].VerificationToken)
+	if verificationToken == "" {
+		verificationToken = readState(keyVerificationToken)
+	}
+
+	dkim, err := client.GetIdentityDkimAttributes(context.TODO(), &ses.GetIdentityDkimAttributesInput{
+		Identities: []string{domain},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DKIM attributes for domain %s: %v", domain, err)
+	}
+
+	return BuildDNSRecords(domain, storage.AWSRegion(), verificationToken, dkim.DkimAttributes[domain].DkimTokens), nil
+}
+
+// ExpectedDNSRecords returns the records SES expects for domain without
+// changing anything in AWS: the verification token saved during setup and the
+// DKIM tokens SES already has for the identity. Records whose tokens are not
+// known yet are left out.
+func ExpectedDNSRecords(domain string) ([]DNSRecord, error) {
+	client, err := newSESClient(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.GetIdentityDkimAttributes(context.TODO(), &ses.GetIdentityDkimAttributesInput{
+		Identities: []string{domain},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DKIM attributes for domain %s: %v", domain, err)
+	}
+
+	return BuildDNSRecords(domain, storage.AWSRegion(), readState(keyVerificationToken), resp.DkimAttributes[domain].DkimTokens), nil
+}
+
+// BuildDNSRecords returns the records for domain given its SES verification
+// token and Easy DKIM tokens: the _amazonses TXT record (if the token is
+// known), one CNAME per DKIM token, the MX record for SES inbound in region,
+// an SPF record and a monitoring-only DMARC policy.
+func BuildDNSRecords(domain, region, verificationToken string, dkimTokens []string) []DNSRecord {
+	domain = strings.TrimSuffix(domain, ".")
+
+	var records []DNSRecord
+	if verificationToken != "" {
+		records = append(records, DNSRecord{
+			Purpose: RecordVerification,
+			Name:    "_amazonses." + domain,
+			Type:    "TXT",
+			Value:   verificationToken,
+			TTL:     dnsRecordTTL,
+		})
+	}
+
+	for _, token := range dkimTokens {
+		records = append(records, DNSRecord{
+			Purpose: RecordDKIM,
+			Name:    token + "._domainkey." + domain,
+			Type:    "CNAME",
+			Value:   token + ".dkim.amazonses.com",
+			TTL:     dnsRecordTTL,
+		})
+	}
+
+	records = append(records,
+		DNSRecord{
+			Purpose:  RecordMX,
+			Name:     domain,
+			Type:     "MX",
+			Value:    fmt.Sprintf("inbound-smtp.%s.amazonaws.com", region),
+			Priority: 10,
+			TTL:      dnsRecordTTL,
+		},
+		DNSRecord{
+			Purpose: RecordSPF,
+			Name:    domain,
+			Type:    "TXT",
+			Value:   "v=spf1 include:amazonses.com ~all",
+			TTL:     dnsRecordTTL,
+		},
+		DNSRecord{
+			Purpose: RecordDMARC,
+			Name:    "_dmarc." + domain,
+			Type:    "TXT",
+			Value:   "v=DMARC1; p=none;",
+			TTL:     dnsRecordTTL,
+		},
+	)
+
+	return records
+}
+
+// ZoneFile formats records as a BIND zone file fragment with fully qualified names.
+func ZoneFile(records []DNSRecord) string {
+	var b strings.Builder
+
+	for _, record := range records {
+		fmt.Fprintf(&b, "; %s\n", record.Purpose)
+		switch record.Type {
+		case "TXT":
+			fmt.Fprintf(&b, "%s.\t%d\tIN\tTXT\t%s\n", record.Name, record.TTL, quoteTXT(record.Value))
+		case "MX":
+			fmt.Fprintf(&b, "%s.\t%d\tIN\tMX\t%d %s.\n", record.Name, record.TTL, record.Priority, record.Value)
+		default:
+			fmt.Fprintf(&b, "%s.\t%d\tIN\t%s\t%s.\n", record.Name, record.TTL, record.Type, record.Value)
+		}
+	}
+
+	return b.String()
+}
+
+// RecordsJSON formats records as an indented JSON array.
+func RecordsJSON(records []DNSRecord) (string, error) {
+	jsonRecords, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error marshalling to JSON: %v", err)
+	}
+	return string(jsonRecords), nil
+}
+
+// quoteTXT quotes a TXT value for a zone file, splitting it into 255 byte
+// character-strings as RFC 1035 requires.
+func quoteTXT(value string) string {
+	var chunks []string
+	for len(value) > 255 {
+		chunks = append(chunks, value[:255])
+		value = value[255:]
+	}
+	chunks = append(chunks, value)
+
+	for i, chunk := range chunks {
+		chunk = strings.ReplaceAll(chunk, `\`, `\\`)
+		chunk = strings.ReplaceAll(chunk, `"`, `\"`)
+		chunks[i] = `"` + chunk + `"`
+	}
+	return strings.Join(chunks, " ")
+}
@@ -5,20 +5,16 @@ import (
 	"fmt"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ses"
 )
 
 func VerifyDomain(domain string) (string, error) {
-	// Load AWS SDK config with default credentials and shared config profile.
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithSharedConfigProfile("AstroMailApp"), config.WithRegion("us-east-1"))
+	// Create SES client from AstroMail's AWS settings.
+	client, err := newSESClient(context.TODO())
 	if err != nil {
-		return "", fmt.Errorf("failed to load SDK configuration: %v", err)
+		return "", err
 	}
 
-	// Create SES client.
-	client := ses.NewFromConfig(cfg)
-
 	// Call VerifyDomainIdentity API to verify the domain identity.
 	resp, err := client.VerifyDomainIdentity(context.TODO(), &ses.VerifyDomainIdentityInput{
 		Domain: aws.String(domain),
@@ -35,15 +31,29 @@ func VerifyDomain(domain string) (string, error) {
 	return verificationToken, nil
 }
 
-func IsDomainVerified(domain string) (string, error) {
-	// Load AWS SDK config with default credentials and shared config profile.
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithSharedConfigProfile("AstroMailApp"), config.WithRegion("us-east-1"))
+// EnableDomainDkim asks SES to create the Easy DKIM tokens for domain and
+// returns them. Calling it again returns the same tokens.
+func EnableDomainDkim(domain string) ([]string, error) {
+	client, err := newSESClient(context.TODO())
 	if err != nil {
-		return "Failed", fmt.Errorf("failed to load SDK configuration: %v", err)
+		return nil, err
 	}
 
-	// Create SES client.
-	client := ses.NewFromConfig(cfg)
+	resp, err := client.VerifyDomainDkim(context.TODO(), &ses.VerifyDomainDkimInput{
+		Domain: aws.String(domain),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DKIM tokens for domain %s: %v", domain, err)
+	}
+	return resp.DkimTokens, nil
+}
+
+func IsDomainVerified(domain string) (string, error) {
+	// Create SES client from AstroMail's AWS settings.
+	client, err := newSESClient(context.TODO())
+	if err != nil {
+		return "Failed", err
+	}
 
 	// Call GetIdentityVerificationAttributes API to get the verification status.
 	resp, err := client.GetIdentityVerificationAttributes(context.TODO(), &ses.GetIdentityVerificationAttributesInput{
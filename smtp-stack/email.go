@@ -4,122 +4,330 @@ import (
 	storage "AstroMail/config"
 	emailparser "AstroMail/email-parser"
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/aws/aws-sdk-go-v2/service/ses"
 	"github.com/aws/aws-sdk-go-v2/service/ses/types"
 )
 
-func SendEmail(sender, subject, body string, recipient, ccAddresses []string) error {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithSharedConfigProfile("AstroMailApp"), config.WithRegion("us-east-1"))
+// Names of the SES and IAM resources AstroMail creates.
+const (
+	receiptRuleSetName   = "SESForwardingRuleSet"
+	receiptRuleName      = "ForwardToS3Rule"
+	forwardingRoleName   = "SESS3ForwardingRole"
+	forwardingPolicyName = "SESS3ForwardingPolicy"
+	emailObjectPrefix    = "emails/"
+)
+
+// SendEmail builds a MIME message with the given attachments, sends it
+// through the transport configured for sender and saves the bytes that were
+// sent in the sent folder of store.
+func SendEmail(store *storage.Store, sender, subject, body string, recipient, ccAddresses []string, attachments []emailparser.OutgoingAttachment) error {
+	return sendMessage(store, &emailparser.OutgoingEmail{
+		From:        sender,
+		To:          recipient,
+		Cc:          ccAddresses,
+		Subject:     subject,
+		HTML:        body,
+		Attachments: attachments,
+	})
+}
+
+// SendReply replies from sender to the stored message with the given
+// Message-ID, quoting it below body, and flags the message as answered. With
+// all set the reply also goes to the original's other recipients.
+func SendReply(store *storage.Store, sender, messageID, body string, all bool, attachments []emailparser.OutgoingAttachment) error {
+	original, folder, key, err := loadStoredEmail(store, messageID)
 	if err != nil {
-		return fmt.Errorf("failed to load SDK configuration: %v", err)
+		return err
 	}
 
-	client := ses.NewFromConfig(cfg)
+	email := emailparser.BuildReply(original, sender, body, all)
+	if len(email.To) == 0 {
+		return fmt.Errorf("message %s has no address to reply to", messageID)
+	}
+	email.Attachments = attachments
+	if err := sendMessage(store, email); err != nil {
+		return err
+	}
 
-	input := &ses.SendEmailInput{
-		Destination: &types.Destination{
-			CcAddresses: ccAddresses,
-			ToAddresses: recipient,
-		},
-		Message: &types.Message{
-			Body: &types.Body{
-				Html: &types.Content{
-					Charset: aws.String("UTF-8"),
-					Data:    aws.String(body),
-				},
-			},
-			Subject: &types.Content{
-				Charset: aws.String("UTF-8"),
-				Data:    aws.String(subject),
-			},
-		},
-		Source: aws.String(sender),
+	if _, err := store.SetFlags(folder, []string{key}, []string{storage.FlagAnswered}, true); err != nil {
+		fmt.Println("Failed to flag message as answered: ", err)
 	}
+	return nil
+}
 
-	sendEmailResponse, err := client.SendEmail(context.TODO(), input)
+// SendForward forwards the stored message with the given Message-ID, with its
+// attachments, from sender to recipient below body.
+func SendForward(store *storage.Store, sender, messageID, body string, recipient []string, attachments []emailparser.OutgoingAttachment) error {
+	original, _, _, err := loadStoredEmail(store, messageID)
 	if err != nil {
-		return fmt.Errorf("failed to send email: %v", err)
+		return err
 	}
-	fmt.Println("Send email response: ", sendEmailResponse)
 
-	fmt.Println("Email sent successfully!")
-	sentEmailEml := emailparser.CreateEMLString(sender, subject, body, recipient, ccAddresses, *sendEmailResponse.MessageId)
-	err = storage.SaveEmail(*sendEmailResponse.MessageId, sentEmailEml, "sent")
-	fmt.Println("Message ID:", *sendEmailResponse.MessageId)
-	fmt.Println(sentEmailEml)
-	return nil
+	email, err := emailparser.BuildForward(original, sender, recipient, body)
+	if err != nil {
+		return err
+	}
+	email.Attachments = append(email.Attachments, attachments...)
+	return sendMessage(store, email)
 }
 
-func ConfigureSESReceiptRules(domain, username, roleARN, bucket string) error {
-	// Load AWS SDK config with default credentials and shared config profile.
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithSharedConfigProfile("AstroMailApp"),
-		config.WithRegion("us-east-1"),
-	)
+// loadStoredEmail finds a stored message by its Message-ID, or by the key it
+// is saved under in the inbox or sent folder, and parses it. It returns the
+// folder and key the message is saved under.
+func loadStoredEmail(store *storage.Store, messageID string) (*emailparser.Email, string, string, error) {
+	folder, key, err := store.LookupMessage(messageID)
 	if err != nil {
-		return fmt.Errorf("failed to load SDK configuration: %v", err)
+		return nil, "", "", err
 	}
 
-	// Create SES client.
-	client := ses.NewFromConfig(cfg)
+	var content string
+	if folder != "" {
+		if content, err = store.RetrieveEmail(folder, key); err != nil {
+			return nil, "", "", err
+		}
+	}
+	for _, candidate := range []string{"inbox", "sent"} {
+		if content != "" {
+			break
+		}
+		folder, key = candidate, messageID
+		if content, err = store.RetrieveEmail(folder, key); err != nil {
+			return nil, "", "", err
+		}
+	}
+	if content == "" {
+		return nil, "", "", fmt.Errorf("message %s not found", messageID)
+	}
 
-	// Create receipt rule set.
-	_, err = client.CreateReceiptRuleSet(context.TODO(), &ses.CreateReceiptRuleSetInput{
-		RuleSetName: aws.String("SESForwardingRuleSet"),
+	email, err := emailparser.ParseEmail(content)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	FixLegacyMessageID(folder, key, email)
+	return email, folder, key, nil
+}
+
+// FixLegacyMessageID corrects the Message-ID of sent mail saved by older
+// versions of AstroMail, which made one up instead of using the one SES gave
+// the message. Replies and threading must use the real one.
+func FixLegacyMessageID(folder, key string, email *emailparser.Email) {
+	if folder == "sent" && email.MessageID == key+"@mail.gmail.com" {
+		email.MessageID = sesMessageID(key)
+	}
+}
+
+// sendMessage sends email through the transport configured for its sender
+// and saves the bytes that were sent in the sent folder of store.
+func sendMessage(store *storage.Store, email *emailparser.OutgoingEmail) error {
+	transport, err := TransportFor(email.From)
+	if err != nil {
+		return err
+	}
+
+	raw, err := emailparser.BuildMIMEMessage(email)
+	if err != nil {
+		return err
+	}
+
+	messageID, err := transport.Send(context.TODO(), email, raw)
+	if err != nil {
+		return err
+	}
+	if messageID != email.MessageID {
+		raw = emailparser.SetMessageID(raw, messageID)
+	}
+
+	fmt.Println("Email sent successfully! Message ID:", messageID)
+	if err := store.SaveEmail(messageID, string(raw), "sent"); err != nil {
+		fmt.Println("Failed to save sent email: ", err)
+		return nil
+	}
+	err = store.IndexThread(storage.ThreadMessage{
+		Folder:     "sent",
+		Key:        messageID,
+		MessageID:  messageID,
+		InReplyTo:  email.InReplyTo,
+		References: email.References,
+		Subject:    email.Subject,
+		Date:       email.Date,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to create receipt rule set: %v", err)
+		fmt.Println("Failed to index sent email: ", err)
 	}
+	return nil
+}
 
-	// Create receipt rule to forward emails to S3 bucket.
-	_, err = client.CreateReceiptRule(context.TODO(), &ses.CreateReceiptRuleInput{
-		Rule: &types.ReceiptRule{
-			Actions: []types.ReceiptAction{
-				{
-					S3Action: &types.S3Action{
-						BucketName:      aws.String(bucket),
-						ObjectKeyPrefix: aws.String("emails/"),
-						TopicArn:        nil,
-					},
+// ErrReceiptRulesNotConfirmed is returned by ConfigureSESReceiptRules when it
+// would change SES receipt rules but the change has not been confirmed.
+var ErrReceiptRulesNotConfirmed = errors.New("receipt rule change has not been confirmed")
+
+// ReceiptRuleOptions controls how ConfigureSESReceiptRules installs AstroMail's rule.
+type ReceiptRuleOptions struct {
+	// After is the rule in the target rule set that AstroMail's rule is
+	// placed after. Empty puts it first.
+	After string
+	// Confirmed must be set before any rule set is created, changed or activated.
+	Confirmed bool
+}
+
+// ReceiptRulePlan describes what ConfigureSESReceiptRules will change.
+type ReceiptRulePlan struct {
+	// RuleSet is the rule set AstroMail's rule is added to.
+	RuleSet string `json:"ruleSet"`
+	// Merge is true when RuleSet is a rule set someone else already has
+	// active. Otherwise AstroMail creates and activates its own rule set.
+	Merge bool `json:"merge"`
+	// ExistingRules lists the rules already in RuleSet, in order.
+	ExistingRules []string `json:"existingRules"`
+	// Active is the rule set active before the change, or "" if none is.
+	Active string `json:"active"`
+}
+
+// PlanSESReceiptRules reports which rule set ConfigureSESReceiptRules would
+// add AstroMail's rule to without changing anything.
+func PlanSESReceiptRules() (*ReceiptRulePlan, error) {
+	client, err := newSESClient(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	return planReceiptRules(context.TODO(), client)
+}
+
+func planReceiptRules(ctx context.Context, client *ses.Client) (*ReceiptRulePlan, error) {
+	active, err := client.DescribeActiveReceiptRuleSet(ctx, &ses.DescribeActiveReceiptRuleSetInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe active receipt rule set: %v", err)
+	}
+
+	plan := &ReceiptRulePlan{RuleSet: receiptRuleSetName}
+	if active.Metadata != nil {
+		plan.Active = aws.ToString(active.Metadata.Name)
+		plan.RuleSet = plan.Active
+		plan.Merge = plan.RuleSet != receiptRuleSetName
+		for _, rule := range active.Rules {
+			if name := aws.ToString(rule.Name); name != receiptRuleName {
+				plan.ExistingRules = append(plan.ExistingRules, name)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// ConfigureSESReceiptRules adds a rule that stores mail for username@domain in
+// bucket and, if topicARN is set, announces it on that SNS topic. If another
+// receipt rule set is already active the rule is merged into it at the
+// position given by opts; otherwise AstroMail's own rule set is created and
+// activated. If opts.Confirmed is not set nothing is changed and
+// ErrReceiptRulesNotConfirmed is returned along with the plan.
+// Running it again updates the existing rule instead of failing.
+func ConfigureSESReceiptRules(domain, username, roleARN, bucket, topicARN string, opts ReceiptRuleOptions) (*ReceiptRulePlan, error) {
+	// Create SES client from AstroMail's AWS settings.
+	client, err := newSESClient(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := planReceiptRules(context.TODO(), client)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Confirmed {
+		return plan, ErrReceiptRulesNotConfirmed
+	}
+
+	// Create receipt rule set unless we are merging into an existing one.
+	if !plan.Merge {
+		_, err = client.CreateReceiptRuleSet(context.TODO(), &ses.CreateReceiptRuleSetInput{
+			RuleSetName: aws.String(plan.RuleSet),
+		})
+		if err != nil && !isAlreadyExists(err) {
+			return plan, fmt.Errorf("failed to create receipt rule set: %v", err)
+		}
+	}
+
+	// Rule to forward emails to S3 bucket.
+	rule := &types.ReceiptRule{
+		Actions: []types.ReceiptAction{
+			{
+				S3Action: &types.S3Action{
+					BucketName:      aws.String(bucket),
+					ObjectKeyPrefix: aws.String(emailObjectPrefix),
+					TopicArn:        topicArn(topicARN),
 				},
 			},
-			Enabled:     true,
-			Name:        aws.String("ForwardToS3Rule"),
-			ScanEnabled: false,
-			Recipients: []string{
-				username + "@" + domain, // Forward all emails sent to the specified domain
-			},
 		},
-		RuleSetName: aws.String("SESForwardingRuleSet"),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create receipt rule: %v", err)
+		Enabled:     true,
+		Name:        aws.String(receiptRuleName),
+		ScanEnabled: false,
+		Recipients: []string{
+			username + "@" + domain, // Forward all emails sent to the specified domain
+		},
+	}
+
+	var after *string
+	if opts.After != "" {
+		after = aws.String(opts.After)
 	}
 
-	// Activate the receipt rule set.
-	_, err = client.SetActiveReceiptRuleSet(context.TODO(), &ses.SetActiveReceiptRuleSetInput{
-		RuleSetName: aws.String("SESForwardingRuleSet"),
+	_, err = client.CreateReceiptRule(context.TODO(), &ses.CreateReceiptRuleInput{
+		After:       after,
+		Rule:        rule,
+		RuleSetName: aws.String(plan.RuleSet),
 	})
+	if isAlreadyExists(err) {
+		// Setup is being re-run: refresh the rule and move it into place.
+		_, err = client.UpdateReceiptRule(context.TODO(), &ses.UpdateReceiptRuleInput{
+			Rule:        rule,
+			RuleSetName: aws.String(plan.RuleSet),
+		})
+		if err == nil {
+			_, err = client.SetReceiptRulePosition(context.TODO(), &ses.SetReceiptRulePositionInput{
+				After:       after,
+				RuleName:    aws.String(receiptRuleName),
+				RuleSetName: aws.String(plan.RuleSet),
+			})
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to activate receipt rule set: %v", err)
+		return plan, fmt.Errorf("failed to create receipt rule: %v", err)
 	}
 
-	fmt.Println("SES receipt rules configured and activated successfully.")
-	return nil
+	// Activate the receipt rule set. A merged rule set is already active.
+	if !plan.Merge {
+		_, err = client.SetActiveReceiptRuleSet(context.TODO(), &ses.SetActiveReceiptRuleSetInput{
+			RuleSetName: aws.String(plan.RuleSet),
+		})
+		if err != nil {
+			return plan, fmt.Errorf("failed to activate receipt rule set: %v", err)
+		}
+	}
+
+	fmt.Println("SES receipt rules configured in", plan.RuleSet)
+	return plan, nil
 }
 
-func CreateSESPolicyAndRole(domain, bucket string) (string, error) {
-	// Load AWS SDK config with default credentials and shared config profile.
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithSharedConfigProfile("AstroMailApp"), config.WithRegion("us-east-1"))
-	if err != nil {
-		return "", fmt.Errorf("failed to load SDK configuration: %v", err)
+// topicArn returns the TopicArn of an action, nil if arn is "".
+func topicArn(arn string) *string {
+	if arn == "" {
+		return nil
 	}
+	return aws.String(arn)
+}
+
+// isAlreadyExists reports whether err is the SES error for a resource that already exists.
+func isAlreadyExists(err error) bool {
+	var exists *types.AlreadyExistsException
+	return errors.As(err, &exists)
+}
 
+func CreateSESPolicyAndRole(domain, bucket string) (string, error) {
 	// Generate SES policy document.
 	policy := fmt.Sprintf(`{
         "Version": "2012-10-17",
@@ -135,11 +343,14 @@ func CreateSESPolicyAndRole(domain, bucket string) (string, error) {
         }]
     }`, bucket, domain)
 
-	// Create IAM client.
-	iamClient := iam.NewFromConfig(cfg)
+	// Create IAM client from AstroMail's AWS settings.
+	iamClient, err := newIAMClient(context.TODO())
+	if err != nil {
+		return "", err
+	}
 
 	// Check if IAM role exists, if not create it.
-	roleName := "SESS3ForwardingRole"
+	roleName := forwardingRoleName
 	roleArn := ""
 	roleExists := false
 	listRolesOutput, err := iamClient.ListRoles(context.TODO(), &iam.ListRolesInput{})
@@ -177,7 +388,7 @@ func CreateSESPolicyAndRole(domain, bucket string) (string, error) {
 	// Attach policy to the IAM role.
 	_, err = iamClient.PutRolePolicy(context.TODO(), &iam.PutRolePolicyInput{
 		PolicyDocument: aws.String(policy),
-		PolicyName:     aws.String("SESS3ForwardingPolicy"),
+		PolicyName:     aws.String(forwardingPolicyName),
 		RoleName:       aws.String(roleName),
 	})
 	if err != nil {
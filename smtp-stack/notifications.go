@@ -0,0 +1,375 @@
+package smtpstack
+
+import (
+	storage "AstroMail/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// queueWaitSeconds is how long one SQS receive waits for a message, the
+// longest SQS allows.
+const queueWaitSeconds = 20
+
+// MailNotifications are the SNS topic SES announces new mail on and the SQS
+// queue subscribed to it.
+type MailNotifications struct {
+	TopicArn        string
+	QueueURL        string
+	SubscriptionArn string
+}
+
+// CreateMailNotifications creates the SNS topic SES publishes to when it
+// stores mail for domain, and an SQS queue subscribed to it that AstroMail
+// long-polls. Both are named after the domain and creating them again
+// returns the existing ones.
+func CreateMailNotifications(ctx context.Context, domain string) (*MailNotifications, error) {
+	snsClient, err := newSNSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sqsClient, err := newSQSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	name := notificationsName(domain)
+
+	topic, err := snsClient.CreateTopic(ctx, &sns.CreateTopicInput{Name: aws.String(name)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create topic: %v", err)
+	}
+	topicArn := aws.ToString(topic.TopicArn)
+
+	// Only SES receiving mail for this account may publish
+	topicPolicy := fmt.Sprintf(`{
+        "Version": "2012-10-17",
+        "Statement": [{
+            "Effect": "Allow",
+            "Principal": {"Service": "ses.amazonaws.com"},
+            "Action": "sns:Publish",
+            "Resource": "%s",
+            "Condition": {"StringEquals": {"AWS:SourceAccount": "%s"}}
+        }]
+    }`, topicArn, arnAccount(topicArn))
+	_, err = snsClient.SetTopicAttributes(ctx, &sns.SetTopicAttributesInput{
+		TopicArn:       aws.String(topicArn),
+		AttributeName:  aws.String("Policy"),
+		AttributeValue: aws.String(topicPolicy),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set topic policy: %v", err)
+	}
+
+	queue, err := sqsClient.CreateQueue(ctx, &sqs.CreateQueueInput{
+		QueueName: aws.String(name),
+		Attributes: map[string]string{
+			"ReceiveMessageWaitTimeSeconds": fmt.Sprint(queueWaitSeconds),
+			"MessageRetentionPeriod":        "1209600",
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create queue: %v", err)
+	}
+	queueURL := aws.ToString(queue.QueueUrl)
+
+	attributes, err := sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueURL),
+		AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNameQueueArn},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue attributes: %v", err)
+	}
+	queueArn := attributes.Attributes[string(sqstypes.QueueAttributeNameQueueArn)]
+
+	queuePolicy := fmt.Sprintf(`{
+        "Version": "2012-10-17",
+        "Statement": [{
+            "Effect": "Allow",
+            "Principal": {"Service": "sns.amazonaws.com"},
+            "Action": "sqs:SendMessage",
+            "Resource": "%s",
+            "Condition": {"ArnEquals": {"aws:SourceArn": "%s"}}
+        }]
+    }`, queueArn, topicArn)
+	_, err = sqsClient.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{
+		QueueUrl:   aws.String(queueURL),
+		Attributes: map[string]string{"Policy": queuePolicy},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set queue policy: %v", err)
+	}
+
+	// Raw delivery puts the SES notification in the message body as is
+	subscription, err := snsClient.Subscribe(ctx, &sns.SubscribeInput{
+		TopicArn:              aws.String(topicArn),
+		Protocol:              aws.String("sqs"),
+		Endpoint:              aws.String(queueArn),
+		Attributes:            map[string]string{"RawMessageDelivery": "true"},
+		ReturnSubscriptionArn: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe queue to topic: %v", err)
+	}
+
+	return &MailNotifications{
+		TopicArn:        topicArn,
+		QueueURL:        queueURL,
+		SubscriptionArn: aws.ToString(subscription.SubscriptionArn),
+	}, nil
+}
+
+// deleteMailNotifications removes the subscription, topic and queue
+// CreateMailNotifications made. Missing ones are skipped.
+func deleteMailNotifications(ctx context.Context, snsClient *sns.Client, sqsClient *sqs.Client, notifications MailNotifications) error {
+	if notifications.SubscriptionArn != "" {
+		_, err := snsClient.Unsubscribe(ctx, &sns.UnsubscribeInput{SubscriptionArn: aws.String(notifications.SubscriptionArn)})
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to unsubscribe queue: %v", err)
+		}
+	}
+	if notifications.TopicArn != "" {
+		_, err := snsClient.DeleteTopic(ctx, &sns.DeleteTopicInput{TopicArn: aws.String(notifications.TopicArn)})
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete topic: %v", err)
+		}
+	}
+	if notifications.QueueURL != "" {
+		_, err := sqsClient.DeleteQueue(ctx, &sqs.DeleteQueueInput{QueueUrl: aws.String(notifications.QueueURL)})
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete queue: %v", err)
+		}
+	}
+	return nil
+}
+
+// MailQueue receives the notifications SES sends when it stores new mail.
+type MailQueue struct {
+	client *sqs.Client
+	url    string
+}
+
+// QueuedMail is a notification received from a MailQueue. Key is "" for
+// notifications that are not about stored mail, which only need deleting.
+type QueuedMail struct {
+	Bucket        string
+	Key           string
+	receiptHandle string
+}
+
+// sesNotification is the part of an SES receipt notification AstroMail reads.
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	Receipt          struct {
+		Action struct {
+			Type       string `json:"type"`
+			BucketName string `json:"bucketName"`
+			ObjectKey  string `json:"objectKey"`
+		} `json:"action"`
+	} `json:"receipt"`
+}
+
+// snsEnvelope wraps a notification delivered without raw message delivery.
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// NewMailQueue returns a MailQueue reading the SQS queue at url.
+func NewMailQueue(ctx context.Context, url string) (*MailQueue, error) {
+	client, err := newSQSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &MailQueue{client: client, url: url}, nil
+}
+
+// Receive waits up to 20 seconds for notifications and returns the ones that
+// arrived, or none if the wait ran out or ctx was cancelled.
+func (q *MailQueue) Receive(ctx context.Context) ([]QueuedMail, error) {
+	output, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(q.url),
+		MaxNumberOfMessages: 10,
+		WaitTimeSeconds:     queueWaitSeconds,
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to receive from queue: %v", err)
+	}
+
+	mails := make([]QueuedMail, 0, len(output.Messages))
+	for _, message := range output.Messages {
+		mail := QueuedMail{receiptHandle: aws.ToString(message.ReceiptHandle)}
+		body := aws.ToString(message.Body)
+
+		var envelope snsEnvelope
+		if json.Unmarshal([]byte(body), &envelope) == nil && envelope.Type == "Notification" {
+			body = envelope.Message
+		}
+		var notification sesNotification
+		if json.Unmarshal([]byte(body), &notification) == nil &&
+			notification.NotificationType == "Received" && notification.Receipt.Action.Type == "S3" {
+			mail.Bucket = notification.Receipt.Action.BucketName
+			mail.Key = notification.Receipt.Action.ObjectKey
+		}
+		mails = append(mails, mail)
+	}
+	return mails, nil
+}
+
+// Delete removes handled notifications from the queue.
+func (q *MailQueue) Delete(ctx context.Context, mails []QueuedMail) error {
+	for start := 0; start < len(mails); start += 10 {
+		end := start + 10
+		if end > len(mails) {
+			end = len(mails)
+		}
+		entries := make([]sqstypes.DeleteMessageBatchRequestEntry, 0, end-start)
+		for i, mail := range mails[start:end] {
+			entries = append(entries, sqstypes.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(fmt.Sprint(i)),
+				ReceiptHandle: aws.String(mail.receiptHandle),
+			})
+		}
+		_, err := q.client.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(q.url),
+			Entries:  entries,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete from queue: %v", err)
+		}
+	}
+	return nil
+}
+
+// SyncQueued downloads the mail named by notifications from queue into the
+// inbox of store and deletes the notifications it handled. Ones whose mail
+// could not be fetched stay in the queue, which delivers them again; the
+// listing in SyncInbox would find that mail too. Saved objects are then
+// retained as opts.Retention says, and those left in the bucket are recorded
+// in the sync state so SyncInbox does not download them again.
+func SyncQueued(ctx context.Context, store *storage.Store, bucket string, queue *MailQueue, mails []QueuedMail, opts SyncOptions) (*SyncResult, error) {
+	client, err := newS3Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state, err := store.RetrieveSyncState(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	downloads := make([]download, len(mails))
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, opts.Concurrency)
+	for i, mail := range mails {
+		if mail.Key == "" || mail.Bucket != bucket || state.IsAhead(mail.Key) {
+			continue
+		}
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int, key string) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			downloads[i] = downloadObject(ctx, client, bucket, key)
+		}(i, mail.Key)
+	}
+	wg.Wait()
+
+	result := &SyncResult{}
+	var handled []QueuedMail
+	var saved []savedObject
+	for i, mail := range mails {
+		key := strings.TrimPrefix(mail.Key, emailObjectPrefix)
+		if mail.Key == "" || mail.Bucket != bucket || state.IsAhead(mail.Key) || key == sesSetupNotification {
+			handled = append(handled, mail)
+			continue
+		}
+		result.Listed++
+
+		err := downloads[i].err
+		if err == nil && state.Synced(mail.Key, downloads[i].modified) {
+			// A listing got to it first
+			handled = append(handled, mail)
+			continue
+		}
+		var noSuchKey *s3types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			// Already saved and archived or deleted, and this is a
+			// redelivered or stale notification
+			handled = append(handled, mail)
+			continue
+		}
+		if err == nil {
+			err = store.SaveEmail(key, downloads[i].content, storage.FolderInbox)
+			switch {
+			case errors.Is(err, storage.ErrEmailExists):
+				err = nil
+			case err == nil:
+				result.Saved++
+				if opts.Saved != nil {
+					opts.Saved(key, downloads[i].content)
+				}
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			fmt.Printf("Failed to fetch %s: %v\n", mail.Key, err)
+			result.Failed++
+			continue
+		}
+		saved = append(saved, savedObject{key: mail.Key, etag: downloads[i].etag})
+		handled = append(handled, mail)
+	}
+
+	// Objects still in the bucket are skipped when a listing reaches them;
+	// the ones retention removed will never be listed
+	removed := retainObjects(ctx, client, store, bucket, saved, opts)
+	result.Retained = len(removed)
+	for _, object := range saved {
+		if !removed[object.key] {
+			state.MarkAhead(object.key)
+		}
+	}
+	if err := store.SaveSyncState(bucket, state); err != nil {
+		return result, err
+	}
+
+	if err := queue.Delete(ctx, handled); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// notificationsName names the topic and queue for domain. SNS and SQS names
+// only allow letters, digits, hyphens and underscores.
+func notificationsName(domain string) string {
+	name := strings.ReplaceAll(makeAWSS3BucketNameCompliant("AstroMail-"+domain), ".", "-")
+	if len(name) > 80 {
+		name = name[:80]
+	}
+	return name
+}
+
+// arnAccount returns the account ID in an ARN.
+func arnAccount(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[4]
+}
@@ -0,0 +1,158 @@
+package smtpstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Resolver is the part of *net.Resolver the DNS preflight check uses. Pass a
+// *net.Resolver whose Dial points at a stub server to check against it.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupCNAME(ctx context.Context, host string) (string, error)
+}
+
+// RecordCheck is the result of checking one expected record against DNS.
+type RecordCheck struct {
+	Record      DNSRecord `json:"record"`
+	Pass        bool      `json:"pass"`
+	Found       []string  `json:"found"`
+	Explanation string    `json:"explanation"`
+}
+
+// CheckDNSRecords resolves every expected record with resolver and reports
+// whether what is published matches what SES needs. A nil resolver uses
+// net.DefaultResolver.
+func CheckDNSRecords(ctx context.Context, resolver Resolver, expected []DNSRecord) []RecordCheck {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	checks := make([]RecordCheck, 0, len(expected))
+	for _, record := range expected {
+		var check RecordCheck
+		switch record.Purpose {
+		case RecordMX:
+			check = checkMX(ctx, resolver, record)
+		case RecordDKIM:
+			check = checkCNAME(ctx, resolver, record)
+		case RecordSPF:
+			check = checkTXT(ctx, resolver, record, "v=spf1", func(found string) bool {
+				return strings.Contains(found, "include:amazonses.com")
+			})
+		case RecordDMARC:
+			check = checkTXT(ctx, resolver, record, "v=DMARC1", func(string) bool { return true })
+		default:
+			check = checkTXT(ctx, resolver, record, "", func(found string) bool { return found == record.Value })
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// FailedChecks returns the checks that did not pass.
+func FailedChecks(checks []RecordCheck) []RecordCheck {
+	var failed []RecordCheck
+	for _, check := range checks {
+		if !check.Pass {
+			failed = append(failed, check)
+		}
+	}
+	return failed
+}
+
+func checkMX(ctx context.Context, resolver Resolver, record DNSRecord) RecordCheck {
+	check := RecordCheck{Record: record}
+
+	mxs, err := resolver.LookupMX(ctx, record.Name)
+	if err != nil {
+		check.Explanation = lookupFailure("MX", record.Name, err)
+		return check
+	}
+
+	for _, mx := range mxs {
+		check.Found = append(check.Found, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		if sameHost(mx.Host, record.Value) {
+			check.Pass = true
+		}
+	}
+
+	if check.Pass {
+		check.Explanation = fmt.Sprintf("%s delivers to %s", record.Name, record.Value)
+	} else {
+		check.Explanation = fmt.Sprintf("no MX record for %s points to %s, so SES will not receive its mail", record.Name, record.Value)
+	}
+	return check
+}
+
+func checkCNAME(ctx context.Context, resolver Resolver, record DNSRecord) RecordCheck {
+	check := RecordCheck{Record: record}
+
+	target, err := resolver.LookupCNAME(ctx, record.Name)
+	if err != nil {
+		check.Explanation = lookupFailure("CNAME", record.Name, err)
+		return check
+	}
+
+	check.Found = []string{target}
+	check.Pass = sameHost(target, record.Value)
+	if check.Pass {
+		check.Explanation = fmt.Sprintf("%s points to %s", record.Name, record.Value)
+	} else {
+		check.Explanation = fmt.Sprintf("%s points to %s instead of %s, so DKIM signing will fail", record.Name, target, record.Value)
+	}
+	return check
+}
+
+// checkTXT looks up the TXT records of record.Name that start with prefix and
+// passes if exactly one of them is accepted by match. An empty prefix
+// considers every TXT record.
+func checkTXT(ctx context.Context, resolver Resolver, record DNSRecord, prefix string, match func(string) bool) RecordCheck {
+	check := RecordCheck{Record: record}
+
+	txts, err := resolver.LookupTXT(ctx, record.Name)
+	if err != nil {
+		check.Explanation = lookupFailure("TXT", record.Name, err)
+		return check
+	}
+
+	matches := 0
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, prefix) {
+			continue
+		}
+		check.Found = append(check.Found, txt)
+		if match(txt) {
+			matches++
+		}
+	}
+
+	switch {
+	case prefix != "" && len(check.Found) > 1:
+		check.Explanation = fmt.Sprintf("%s has %d %s records; receivers treat more than one as an error", record.Name, len(check.Found), prefix)
+	case matches > 0:
+		check.Pass = true
+		check.Explanation = fmt.Sprintf("%s %s record is published", record.Name, record.Purpose)
+	case len(check.Found) > 0:
+		check.Explanation = fmt.Sprintf("%s has a %s record but it does not match %q", record.Name, record.Purpose, record.Value)
+	default:
+		check.Explanation = fmt.Sprintf("%s has no %s record; publish %q", record.Name, record.Purpose, record.Value)
+	}
+	return check
+}
+
+func lookupFailure(recordType, name string, err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return fmt.Sprintf("no %s record found for %s", recordType, name)
+	}
+	return fmt.Sprintf("failed to look up %s record for %s: %v", recordType, name, err)
+}
+
+func sameHost(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
@@ -0,0 +1,152 @@
+package smtpstack
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeResolver answers lookups from fixed records. Names are matched the way
+// DNS does, ignoring case and a trailing dot.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	txt   map[string][]string
+	cname map[string]string
+}
+
+func fakeKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[fakeKey(name)]; ok {
+		return mx, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[fakeKey(name)]; ok {
+		return txt, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r fakeResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	if cname, ok := r.cname[fakeKey(host)]; ok {
+		return cname, nil
+	}
+	return "", notFound(host)
+}
+
+func TestCheckDNSRecords(t *testing.T) {
+	expected := BuildDNSRecords("Example.com.", "us-east-1", "verify-token", []string{"dkimtoken"})
+
+	tests := []struct {
+		name     string
+		resolver fakeResolver
+		// pass is whether the check for each purpose passes
+		pass map[string]bool
+		// explain is a fragment expected in the explanation for a purpose
+		explain map[string]string
+	}{
+		{
+			name: "matching",
+			resolver: fakeResolver{
+				mx: map[string][]*net.MX{
+					"example.com": {{Host: "INBOUND-SMTP.us-east-1.amazonaws.com.", Pref: 10}},
+				},
+				txt: map[string][]string{
+					"_amazonses.example.com": {"verify-token"},
+					"example.com":            {"google-site-verification=abc", "v=spf1 include:amazonses.com ~all"},
+					"_dmarc.example.com":     {"v=DMARC1; p=quarantine;"},
+				},
+				cname: map[string]string{
+					"dkimtoken._domainkey.example.com": "DkimToken.dkim.amazonses.com.",
+				},
+			},
+			pass: map[string]bool{RecordVerification: true, RecordDKIM: true, RecordMX: true, RecordSPF: true, RecordDMARC: true},
+		},
+		{
+			name:     "missing",
+			resolver: fakeResolver{},
+			pass:     map[string]bool{},
+			explain: map[string]string{
+				RecordVerification: "no TXT record found",
+				RecordDKIM:         "no CNAME record found",
+				RecordMX:           "no MX record found",
+				RecordDMARC:        "no TXT record found",
+			},
+		},
+		{
+			name: "wrong values",
+			resolver: fakeResolver{
+				mx: map[string][]*net.MX{
+					"example.com": {{Host: "mx.other-provider.net.", Pref: 10}},
+				},
+				txt: map[string][]string{
+					"_amazonses.example.com": {"old-token"},
+					"example.com":            {"v=spf1 include:_spf.other-provider.net ~all"},
+					"_dmarc.example.com":     {"not a dmarc record"},
+				},
+				cname: map[string]string{
+					"dkimtoken._domainkey.example.com": "othertoken.dkim.amazonses.com.",
+				},
+			},
+			pass: map[string]bool{},
+			explain: map[string]string{
+				RecordVerification: "does not match",
+				RecordDKIM:         "instead of",
+				RecordMX:           "points to inbound-smtp.us-east-1.amazonaws.com",
+				RecordSPF:          "does not match",
+				RecordDMARC:        "has no DMARC record",
+			},
+		},
+		{
+			name: "duplicate SPF",
+			resolver: fakeResolver{
+				txt: map[string][]string{
+					"example.com": {"v=spf1 include:amazonses.com ~all", "v=spf1 mx -all"},
+				},
+			},
+			pass:    map[string]bool{},
+			explain: map[string]string{RecordSPF: "has 2 v=spf1 records"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checks := CheckDNSRecords(context.Background(), tt.resolver, expected)
+			if len(checks) != len(expected) {
+				t.Fatalf("got %d checks for %d records", len(checks), len(expected))
+			}
+			for _, check := range checks {
+				purpose := check.Record.Purpose
+				if check.Pass != tt.pass[purpose] {
+					t.Errorf("%s: pass = %v, want %v (%s)", purpose, check.Pass, tt.pass[purpose], check.Explanation)
+				}
+				if want := tt.explain[purpose]; want != "" && !strings.Contains(check.Explanation, want) {
+					t.Errorf("%s: explanation %q does not contain %q", purpose, check.Explanation, want)
+				}
+			}
+			if failed := FailedChecks(checks); len(failed) != len(checks)-countPassing(tt.pass) {
+				t.Errorf("FailedChecks returned %d checks", len(failed))
+			}
+		})
+	}
+}
+
+func countPassing(pass map[string]bool) int {
+	n := 0
+	for _, ok := range pass {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
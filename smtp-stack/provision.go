@@ -0,0 +1,348 @@
+package smtpstack
+
+import (
+	storage "AstroMail/config"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Provisioning steps, in the order Provision runs them.
+const (
+	StepBucket        = "Bucket"
+	StepLifecycle     = "Lifecycle"
+	StepDomain        = "Domain"
+	StepRole          = "Role"
+	StepNotifications = "Notifications"
+	StepReceiptRules  = "ReceiptRules"
+)
+
+// Statuses reported for a step through ProvisionProgress.
+const (
+	StepRunning = "Running"
+	StepDone    = "Done"
+	StepSkipped = "Skipped"
+	StepFailed  = "Failed"
+	// StepNeedsConfirmation means the step stopped before changing anything
+	// and Plan describes what it will do once confirmed.
+	StepNeedsConfirmation = "NeedsConfirmation"
+)
+
+// ProvisionProgress describes the state of one provisioning step.
+type ProvisionProgress struct {
+	Step   string           `json:"step"`
+	Status string           `json:"status"`
+	Detail string           `json:"detail"`
+	Plan   *ReceiptRulePlan `json:"plan,omitempty"`
+}
+
+// Config keys written by Provision. Bucket, Domain, RoleArn, Queue Url and
+// Status are also read by the rest of the app.
+const (
+	keyUsername           = "Username"
+	keyBucket             = "Bucket"
+	keyBucketStatus       = "Bucket Status"
+	keyGlacierRuleDays    = "Glacier Rule Days"
+	keyDomain             = "Domain"
+	keyDomainStatus       = "Domain Status"
+	keyVerificationToken  = "Verification Token"
+	keyRoleArn            = "RoleArn"
+	keyTopicArn           = "Topic Arn"
+	keyQueueURL           = "Queue Url"
+	keySubscriptionArn    = "Subscription Arn"
+	keyReceiptRulesStatus = "Receipt Rules Status"
+	keyPreviousRuleSet    = "Previous Rule Set"
+	keyReceiptRuleSet     = "Receipt Rule Set"
+	keyStatus             = "Status"
+)
+
+// domainVerificationTimeout is how long Provision waits for SES to see the
+// verification record before giving up. Calling Provision again resumes the wait.
+const domainVerificationTimeout = 10 * time.Minute
+
+// Provision creates the AWS stack for domain: the email bucket and, if
+// Glacier Days is set, its lifecycle rule for archived mail, the SES domain
+// identity, the IAM role SES uses to write to the bucket, the SNS topic and
+// SQS queue that announce new mail and the receipt rules.
+// The result of every step is saved to the config file as soon as it
+// completes, so calling Provision again after a failure or a crash resumes
+// from the first step that has not finished. SES receipt rules are only
+// changed if rules.Confirmed is set; otherwise Provision stops at that step
+// with ErrReceiptRulesNotConfirmed after reporting the plan. progress is
+// called whenever a step starts, finishes, is skipped or fails; it may be nil.
+func Provision(ctx context.Context, username, domain string, rules ReceiptRuleOptions, progress func(ProvisionProgress)) error {
+	if progress == nil {
+		progress = func(ProvisionProgress) {}
+	}
+
+	// State saved for another domain or user cannot be reused.
+	if readState(keyDomain) != domain || readState(keyUsername) != username {
+		if err := resetProvisionState(); err != nil {
+			return err
+		}
+		if err := writeState(keyDomain, domain); err != nil {
+			return err
+		}
+		if err := writeState(keyUsername, username); err != nil {
+			return err
+		}
+	}
+
+	steps := []struct {
+		name string
+		done func() bool
+		run  func() (string, error)
+	}{
+		{
+			name: StepBucket,
+			done: func() bool { return readState(keyBucketStatus) == "Created" },
+			run:  func() (string, error) { return provisionBucket(domain) },
+		},
+		{
+			name: StepLifecycle,
+			done: func() bool { return readState(keyGlacierRuleDays) == glacierRuleDays() },
+			run:  func() (string, error) { return provisionLifecycle(ctx) },
+		},
+		{
+			name: StepDomain,
+			done: func() bool { return readState(keyDomainStatus) == "Verified" },
+			run:  func() (string, error) { return provisionDomain(ctx, domain, progress) },
+		},
+		{
+			name: StepRole,
+			done: func() bool { return readState(keyRoleArn) != "" },
+			run:  func() (string, error) { return provisionRole(domain) },
+		},
+		{
+			name: StepNotifications,
+			done: func() bool { return readState(keyTopicArn) != "" && readState(keyQueueURL) != "" },
+			run:  func() (string, error) { return provisionNotifications(ctx, domain) },
+		},
+		{
+			name: StepReceiptRules,
+			done: func() bool { return readState(keyReceiptRulesStatus) == "Configured" },
+			run:  func() (string, error) { return provisionReceiptRules(domain, username, rules, progress) },
+		},
+	}
+
+	for _, step := range steps {
+		if step.done() {
+			progress(ProvisionProgress{Step: step.name, Status: StepSkipped, Detail: "already completed"})
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		progress(ProvisionProgress{Step: step.name, Status: StepRunning})
+		detail, err := step.run()
+		if err != nil {
+			if errors.Is(err, ErrReceiptRulesNotConfirmed) {
+				return err
+			}
+			progress(ProvisionProgress{Step: step.name, Status: StepFailed, Detail: err.Error()})
+			return fmt.Errorf("provisioning step %s failed: %w", step.name, err)
+		}
+		progress(ProvisionProgress{Step: step.name, Status: StepDone, Detail: detail})
+	}
+
+	return writeState(keyStatus, "Working")
+}
+
+func provisionBucket(domain string) (string, error) {
+	bucket, err := CreateEmailBucket(domain)
+	if err != nil {
+		return "", err
+	}
+	if err := writeState(keyBucket, bucket); err != nil {
+		return "", err
+	}
+	if err := writeState(keyBucketStatus, "Created"); err != nil {
+		return "", err
+	}
+	return bucket, nil
+}
+
+// glacierRuleDays is the Glacier Days setting as provisionLifecycle records
+// it, empty when there is no rule.
+func glacierRuleDays() string {
+	if days := storage.GlacierDays(); days > 0 {
+		return fmt.Sprint(days)
+	}
+	return ""
+}
+
+func provisionLifecycle(ctx context.Context) (string, error) {
+	days := storage.GlacierDays()
+	if err := ConfigureArchiveLifecycle(ctx, readState(keyBucket), days); err != nil {
+		return "", err
+	}
+	if err := writeState(keyGlacierRuleDays, glacierRuleDays()); err != nil {
+		return "", err
+	}
+	if days == 0 {
+		return "no Glacier rule", nil
+	}
+	return fmt.Sprintf("archived mail moves to Glacier after %d days", days), nil
+}
+
+func provisionDomain(ctx context.Context, domain string, progress func(ProvisionProgress)) (string, error) {
+	// Only ask SES for a new token if there is no pending verification.
+	status, err := IsDomainVerified(domain)
+	if err != nil || readState(keyVerificationToken) == "" || (status != "Pending" && status != "Success") {
+		token, err := VerifyDomain(domain)
+		if err != nil {
+			return "", err
+		}
+		if _, err := EnableDomainDkim(domain); err != nil {
+			return "", err
+		}
+		if err := writeState(keyVerificationToken, token); err != nil {
+			return "", err
+		}
+		if err := writeState(keyDomainStatus, "Verifying"); err != nil {
+			return "", err
+		}
+	}
+
+	token := readState(keyVerificationToken)
+	progress(ProvisionProgress{
+		Step:   StepDomain,
+		Status: StepRunning,
+		Detail: fmt.Sprintf("waiting for TXT record _amazonses.%s with value %s", domain, token),
+	})
+
+	if err := waitForDomainVerification(ctx, domain); err != nil {
+		return "", err
+	}
+	if err := writeState(keyDomainStatus, "Verified"); err != nil {
+		return "", err
+	}
+	return "Verified", nil
+}
+
+func waitForDomainVerification(ctx context.Context, domain string) error {
+	timeout := time.After(domainVerificationTimeout)
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		status, err := IsDomainVerified(domain)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case "Success":
+			return nil
+		case "Failed", "TemporaryFailure":
+			// Clear the token so the next attempt starts a fresh verification.
+			writeState(keyVerificationToken, "")
+			return fmt.Errorf("SES could not verify domain %s (status %s)", domain, status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("domain %s is not verified yet; publish the verification record and launch again", domain)
+		case <-ticker.C:
+		}
+	}
+}
+
+func provisionRole(domain string) (string, error) {
+	roleArn, err := CreateSESPolicyAndRole(domain, readState(keyBucket))
+	if err != nil {
+		return "", err
+	}
+	if err := writeState(keyRoleArn, roleArn); err != nil {
+		return "", err
+	}
+	return roleArn, nil
+}
+
+func provisionNotifications(ctx context.Context, domain string) (string, error) {
+	notifications, err := CreateMailNotifications(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range map[string]string{
+		keyTopicArn:        notifications.TopicArn,
+		keyQueueURL:        notifications.QueueURL,
+		keySubscriptionArn: notifications.SubscriptionArn,
+	} {
+		if err := writeState(key, value); err != nil {
+			return "", err
+		}
+	}
+
+	// A stack set up before notifications existed has a rule without the
+	// topic; configure it again
+	if err := writeState(keyReceiptRulesStatus, ""); err != nil {
+		return "", err
+	}
+	return notifications.QueueURL, nil
+}
+
+func provisionReceiptRules(domain, username string, opts ReceiptRuleOptions, progress func(ProvisionProgress)) (string, error) {
+	plan, err := PlanSESReceiptRules()
+	if err != nil {
+		return "", err
+	}
+
+	// Remember the rule set that was active before ours so Deprovision can
+	// restore it. A retry after activation must not record our own set.
+	if plan.Active != receiptRuleSetName {
+		if err := writeState(keyPreviousRuleSet, plan.Active); err != nil {
+			return "", err
+		}
+	}
+	if err := writeState(keyReceiptRuleSet, plan.RuleSet); err != nil {
+		return "", err
+	}
+
+	if !opts.Confirmed {
+		detail := fmt.Sprintf("AstroMail will create and activate receipt rule set %s", plan.RuleSet)
+		if plan.Merge {
+			detail = fmt.Sprintf("AstroMail will add its rule to the active receipt rule set %s", plan.RuleSet)
+		}
+		progress(ProvisionProgress{Step: StepReceiptRules, Status: StepNeedsConfirmation, Detail: detail, Plan: plan})
+		return "", ErrReceiptRulesNotConfirmed
+	}
+
+	_, err = ConfigureSESReceiptRules(domain, username, readState(keyRoleArn), readState(keyBucket), readState(keyTopicArn), opts)
+	if err != nil {
+		return "", err
+	}
+	if err := writeState(keyReceiptRulesStatus, "Configured"); err != nil {
+		return "", err
+	}
+	return plan.RuleSet, nil
+}
+
+// resetProvisionState clears every key Provision writes.
+func resetProvisionState() error {
+	for _, key := range []string{
+		keyBucket, keyBucketStatus, keyGlacierRuleDays, keyDomain, keyDomainStatus, keyVerificationToken,
+		keyRoleArn, keyTopicArn, keyQueueURL, keySubscriptionArn, keyReceiptRulesStatus, keyPreviousRuleSet, keyReceiptRuleSet, keyStatus,
+	} {
+		if err := writeState(key, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readState returns the value saved under key, or "" if it is not set.
+func readState(key string) string {
+	value, _ := storage.ReadKeyFromFile(storage.ConfigFile, key)
+	return value
+}
+
+func writeState(key, value string) error {
+	if err := storage.WriteKeyToFile(key, value, storage.ConfigFile); err != nil {
+		return fmt.Errorf("failed to save %s: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package smtpstack
+
+import (
+	storage "AstroMail/config"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// archiveObjectPrefix is where the archive retention policy moves mail. It
+// is outside emailObjectPrefix, so syncs never list it.
+const archiveObjectPrefix = "archive/"
+
+// glacierRuleID names the lifecycle rule ConfigureArchiveLifecycle manages.
+// Other rules on the bucket are left alone.
+const glacierRuleID = "AstroMail-ArchiveToGlacier"
+
+// savedObject is an object whose message a sync saved in the inbox.
+type savedObject struct {
+	key  string
+	etag string
+}
+
+// retainObjects applies opts.Retention to objects, opts.Concurrency at a
+// time, and returns the keys it archived or deleted. An object is only
+// touched once the local copy matches its checksum; objects that fail are
+// logged and left in place.
+func retainObjects(ctx context.Context, client *s3.Client, store *storage.Store, bucket string, objects []savedObject, opts SyncOptions) map[string]bool {
+	removed := make(map[string]bool)
+	if opts.Retention != storage.RetentionArchive && opts.Retention != storage.RetentionDelete {
+		return removed
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, opts.Concurrency)
+	for _, object := range objects {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(object savedObject) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			if err := retainObject(ctx, client, store, bucket, object, opts.Retention); err != nil {
+				fmt.Printf("Failed to %s %s: %v\n", opts.Retention, object.key, err)
+				return
+			}
+			mu.Lock()
+			removed[object.key] = true
+			mu.Unlock()
+		}(object)
+	}
+	wg.Wait()
+	return removed
+}
+
+// retainObject verifies the local copy of object, in whichever folder the
+// message is now, and then archives or deletes it as policy says.
+func retainObject(ctx context.Context, client *s3.Client, store *storage.Store, bucket string, object savedObject, policy string) error {
+	key := strings.TrimPrefix(object.key, emailObjectPrefix)
+	folder, eml, err := store.FindEmail(key)
+	if err != nil {
+		return err
+	}
+	if folder == "" {
+		return errors.New("no local copy to verify it against")
+	}
+	if err := verifyChecksum(eml, object.etag); err != nil {
+		return err
+	}
+
+	if policy == storage.RetentionArchive {
+		_, err := client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(archiveObjectPrefix + key),
+			CopySource: aws.String(bucket + "/" + url.PathEscape(object.key)),
+			// Do not archive an object that changed since it was downloaded
+			CopySourceIfMatch: aws.String(object.etag),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy to %s: %v", archiveObjectPrefix, err)
+		}
+	}
+
+	_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(object.key)})
+	if err != nil {
+		return fmt.Errorf("failed to delete: %v", err)
+	}
+	return nil
+}
+
+// verifyChecksum checks eml against the ETag S3 returned for it. SES stores
+// each message in a single upload, so the ETag is the hex MD5 of the object.
+func verifyChecksum(eml, etag string) error {
+	etag = strings.ToLower(strings.Trim(etag, `"`))
+	if len(etag) != hex.EncodedLen(md5.Size) {
+		return fmt.Errorf("ETag %q is not an MD5 checksum", etag)
+	}
+	sum := md5.Sum([]byte(eml))
+	if hex.EncodeToString(sum[:]) != etag {
+		return errors.New("local copy does not match the checksum in S3")
+	}
+	return nil
+}
+
+// ConfigureArchiveLifecycle sets the lifecycle rule that moves mail under
+// archive/ in bucket to Glacier after days, or removes it if days is 0.
+func ConfigureArchiveLifecycle(ctx context.Context, bucket string, days int) error {
+	client, err := newS3Client(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The whole configuration is replaced, so keep any rules that are not ours
+	var rules []types.LifecycleRule
+	current, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucket)})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to get bucket lifecycle: %v", err)
+	}
+	if err == nil {
+		for _, rule := range current.Rules {
+			if aws.ToString(rule.ID) != glacierRuleID {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	if days > 0 {
+		rules = append(rules, types.LifecycleRule{
+			ID:     aws.String(glacierRuleID),
+			Status: types.ExpirationStatusEnabled,
+			Filter: &types.LifecycleRuleFilterMemberPrefix{Value: archiveObjectPrefix},
+			Transitions: []types.Transition{{
+				Days:         aws.Int32(int32(days)),
+				StorageClass: types.TransitionStorageClassGlacier,
+			}},
+		})
+	}
+
+	if len(rules) == 0 {
+		_, err = client.DeleteBucketLifecycle(ctx, &s3.DeleteBucketLifecycleInput{Bucket: aws.String(bucket)})
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete bucket lifecycle: %v", err)
+		}
+		return nil
+	}
+	_, err = client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(bucket),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: rules},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set bucket lifecycle: %v", err)
+	}
+	return nil
+}
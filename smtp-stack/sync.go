@@ -0,0 +1,287 @@
+package smtpstack
+
+import (
+	storage "AstroMail/config"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// sesSetupNotification is the object SES writes when the receipt rule is
+// created. It is not mail.
+const sesSetupNotification = "AMAZON_SES_SETUP_NOTIFICATION"
+
+// Bounds on retrying a download that S3 throttled.
+const (
+	maxDownloadAttempts = 6
+	baseRetryDelay      = 250 * time.Millisecond
+	maxRetryDelay       = 15 * time.Second
+)
+
+// SyncOptions configures SyncInbox.
+type SyncOptions struct {
+	// Concurrency is how many messages are downloaded at once.
+	Concurrency int
+	// Saved, if set, is called with the key and EML of every message added
+	// to the inbox.
+	Saved func(key, eml string)
+	// Progress, if set, is called after every message with the counts so far.
+	Progress func(SyncProgress)
+	// Retention is what happens to an object once its message is saved:
+	// storage.RetentionKeep, RetentionArchive or RetentionDelete.
+	Retention string
+}
+
+// SyncProgress is how far an inbox sync has got.
+type SyncProgress struct {
+	Fetched int `json:"fetched"`
+	Total   int `json:"total"`
+	Failed  int `json:"failed"`
+}
+
+// SyncResult is what one inbox sync fetched.
+type SyncResult struct {
+	// Listed is the number of new objects found in the bucket.
+	Listed int
+	// Saved is the number of messages added to the inbox.
+	Saved int
+	// Failed is the number of objects that could not be downloaded or saved.
+	// They are fetched again by the next sync.
+	Failed int
+	// Retained is the number of objects archived or deleted after saving.
+	Retained int
+}
+
+// bucketObject is an object found by listing the bucket.
+type bucketObject struct {
+	Key          string
+	LastModified time.Time
+}
+
+// download is the outcome of fetching one object.
+type download struct {
+	content  string
+	modified time.Time
+	etag     string
+	err      error
+	// ahead is set for objects a notification already fetched.
+	ahead bool
+}
+
+// SyncInbox fetches the mail SES has written to bucket since the last sync
+// into the inbox of store. Messages are downloaded by a pool of workers
+// sharing one S3 client and saved in the order they arrived in the bucket.
+// How far it got is kept in the store, so an interrupted or cancelled sync
+// carries on where it stopped. Objects that fail are counted and left for
+// the next sync; only errors that stop the whole sync are returned. Once
+// the sync is done, saved objects are archived or deleted as opts.Retention
+// says.
+func SyncInbox(ctx context.Context, store *storage.Store, bucket string, opts SyncOptions) (*SyncResult, error) {
+	if bucket == "" {
+		return nil, errors.New("no mail bucket is configured")
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	client, err := newS3Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := store.RetrieveSyncState(bucket)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := listNewObjects(ctx, client, bucket, emailObjectPrefix, state)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Each object gets its own channel so results are saved in order while
+	// the workers run ahead
+	results := make([]chan download, len(objects))
+	for i := range results {
+		results[i] = make(chan download, 1)
+	}
+	jobs := make(chan int)
+	for w := 0; w < opts.Concurrency; w++ {
+		go func() {
+			for i := range jobs {
+				results[i] <- downloadObject(ctx, client, bucket, objects[i].Key)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i, obj := range objects {
+			if strings.TrimPrefix(obj.Key, emailObjectPrefix) == sesSetupNotification {
+				results[i] <- download{}
+				continue
+			}
+			if state.IsAhead(obj.Key) {
+				results[i] <- download{ahead: true}
+				continue
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	result := &SyncResult{Listed: len(objects)}
+	fetchedCount := 0
+	report := func() {
+		if opts.Progress != nil {
+			opts.Progress(SyncProgress{Fetched: fetchedCount, Total: result.Listed, Failed: result.Failed})
+		}
+	}
+	report()
+
+	// The sync state only moves past objects that were saved, up to the
+	// first failure
+	advancing := true
+	var saved []savedObject
+	for i, obj := range objects {
+		var fetched download
+		select {
+		case fetched = <-results[i]:
+		case <-ctx.Done():
+			return result, ctx.Err()
+		}
+
+		key := strings.TrimPrefix(obj.Key, emailObjectPrefix)
+		err := fetched.err
+		if err == nil && key != sesSetupNotification && !fetched.ahead {
+			err = store.SaveEmail(key, fetched.content, storage.FolderInbox)
+			switch {
+			case errors.Is(err, storage.ErrEmailExists):
+				// Fetched before the sync state was kept, or by a sync that
+				// stopped before recording it
+				err = nil
+			case err == nil:
+				result.Saved++
+				if opts.Saved != nil {
+					opts.Saved(key, fetched.content)
+				}
+			}
+			if err == nil {
+				saved = append(saved, savedObject{key: obj.Key, etag: fetched.etag})
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			fmt.Printf("Failed to fetch %s: %v\n", obj.Key, err)
+			result.Failed++
+			advancing = false
+		} else {
+			fetchedCount++
+		}
+
+		if advancing {
+			state.Advance(obj.Key, obj.LastModified)
+			if err := store.SaveSyncState(bucket, state); err != nil {
+				return result, err
+			}
+		}
+		report()
+	}
+
+	result.Retained = len(retainObjects(ctx, client, store, bucket, saved, opts))
+	return result, nil
+}
+
+// downloadObject downloads an object, backing off and retrying while S3
+// throttles the requests.
+func downloadObject(ctx context.Context, client *s3.Client, bucket, key string) download {
+	delay := baseRetryDelay
+	for attempt := 1; ; attempt++ {
+		fetched := getObjectContent(ctx, client, bucket, key)
+		if fetched.err == nil || attempt == maxDownloadAttempts || !isThrottle(fetched.err) {
+			return fetched
+		}
+
+		// Full jitter keeps the workers from retrying in step
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(delay)))):
+		case <-ctx.Done():
+			return download{err: ctx.Err()}
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// isThrottle reports whether err is AWS asking for fewer requests.
+func isThrottle(err error) bool {
+	return retry.ThrottleErrorCode{Codes: retry.DefaultThrottleErrorCodes}.IsErrorThrottle(err) == aws.TrueTernary
+}
+
+// listNewObjects lists the objects under prefix that state has not synced,
+// oldest first. SES names objects by message ID, which does not follow
+// arrival order, so every page of the listing is read and filtered by
+// LastModified rather than started after the last key. Objects modified
+// shortly before the last one synced are listed too unless state has their
+// key, so a message SES finished writing late is not skipped.
+func listNewObjects(ctx context.Context, client *s3.Client, bucket, prefix string, state storage.SyncState) ([]bucketObject, error) {
+	var objects []bucketObject
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bucket %s: %v", bucket, err)
+		}
+		for _, obj := range page.Contents {
+			object := bucketObject{Key: aws.ToString(obj.Key), LastModified: aws.ToTime(obj.LastModified)}
+			if strings.HasSuffix(object.Key, "/") || state.Synced(object.Key, object.LastModified) {
+				continue
+			}
+			objects = append(objects, object)
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		if !objects[i].LastModified.Equal(objects[j].LastModified) {
+			return objects[i].LastModified.Before(objects[j].LastModified)
+		}
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func getObjectContent(ctx context.Context, client *s3.Client, bucket, key string) download {
+	result, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return download{err: fmt.Errorf("failed to download %s: %w", key, err)}
+	}
+	defer result.Body.Close()
+
+	content, err := io.ReadAll(result.Body)
+	if err != nil {
+		return download{err: fmt.Errorf("failed to download %s: %v", key, err)}
+	}
+	return download{
+		content:  string(content),
+		modified: aws.ToTime(result.LastModified),
+		etag:     aws.ToString(result.ETag),
+	}
+}
@@ -0,0 +1,34 @@
+package smtpstack
+
+import (
+	storage "AstroMail/config"
+	emailparser "AstroMail/email-parser"
+	"context"
+	"fmt"
+)
+
+// Transport delivers outgoing mail. raw is the rendered message and email
+// supplies its envelope. Send returns the Message-ID, without angle
+// brackets, that recipients see; services that assign their own ID return
+// that instead of email.MessageID.
+type Transport interface {
+	Send(ctx context.Context, email *emailparser.OutgoingEmail, raw []byte) (string, error)
+}
+
+// TransportFor returns the transport configured for the sending identity.
+func TransportFor(identity string) (Transport, error) {
+	settings, err := storage.ReadTransportSettings(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	switch settings.Type {
+	case storage.TransportSES, "":
+		return &SESTransport{}, nil
+	case storage.TransportSMTP:
+		return &SMTPTransport{Host: settings.Host, Port: settings.Port, Username: settings.Username, Password: settings.Password}, nil
+	case storage.TransportFile:
+		return &FileTransport{Dir: settings.Dir}, nil
+	}
+	return nil, fmt.Errorf("unknown transport type %q for %s", settings.Type, identity)
+}
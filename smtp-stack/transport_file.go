@@ -0,0 +1,30 @@
+package smtpstack
+
+import (
+	emailparser "AstroMail/email-parser"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FileTransport writes each message as an .eml file in Dir instead of
+// sending it. It is meant for tests and offline development.
+type FileTransport struct {
+	Dir string
+}
+
+func (t *FileTransport) Send(ctx context.Context, email *emailparser.OutgoingEmail, raw []byte) (string, error) {
+	if t.Dir == "" {
+		return "", fmt.Errorf("file transport has no directory configured")
+	}
+	if err := os.MkdirAll(t.Dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(t.Dir, email.MessageID+".eml")
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return email.MessageID, nil
+}
@@ -0,0 +1,61 @@
+package smtpstack
+
+import (
+	storage "AstroMail/config"
+	emailparser "AstroMail/email-parser"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+// sesMaxMessageSize is the largest raw message SES accepts, after encoding.
+const sesMaxMessageSize = 10 * 1024 * 1024
+
+// ErrMessageTooLarge is returned when a message is over the size a transport accepts.
+var ErrMessageTooLarge = errors.New("message is too large")
+
+// SESTransport sends mail with the SES SendRawEmail API.
+type SESTransport struct{}
+
+// Send delivers raw unchanged. SES replaces the Message-ID header with its own,
+// so the returned ID is the one SES assigned.
+func (t *SESTransport) Send(ctx context.Context, email *emailparser.OutgoingEmail, raw []byte) (string, error) {
+	if len(raw) > sesMaxMessageSize {
+		return "", fmt.Errorf("%w: the encoded message is %.1f MB and SES accepts at most 10 MB including attachments",
+			ErrMessageTooLarge, float64(len(raw))/(1024*1024))
+	}
+
+	client, err := newSESClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	input := &ses.SendRawEmailInput{
+		Destinations: email.Recipients(),
+		RawMessage:   &types.RawMessage{Data: raw},
+		Source:       aws.String(email.From),
+	}
+
+	sendEmailResponse, err := client.SendRawEmail(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to send email: %v", err)
+	}
+	return sesMessageID(aws.ToString(sendEmailResponse.MessageId)), nil
+}
+
+// sesMessageID returns the Message-ID header SES gives a message it sent with
+// the ID returned by the API.
+func sesMessageID(id string) string {
+	return sesRegionMessageID(storage.AWSRegion(), id)
+}
+
+func sesRegionMessageID(region, id string) string {
+	if region == "us-east-1" {
+		return id + "@email.amazonses.com"
+	}
+	return id + "@" + region + ".amazonses.com"
+}
@@ -0,0 +1,167 @@
+package smtpstack
+
+import (
+	emailparser "AstroMail/email-parser"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smtpTimeout bounds a whole SMTP conversation when the context has no
+// deadline of its own.
+const smtpTimeout = 2 * time.Minute
+
+// SMTPTransport submits mail to an SMTP server, upgrading the connection with
+// STARTTLS and authenticating with AUTH PLAIN when credentials are set. It
+// works with the SES SMTP endpoint (email-smtp.<region>.amazonaws.com:587)
+// as well as any other submission server. SES replaces the Message-ID of
+// mail it relays; Send returns the one SES assigned, read from its reply to
+// the message.
+type SMTPTransport struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+func (t *SMTPTransport) Send(ctx context.Context, email *emailparser.OutgoingEmail, raw []byte) (string, error) {
+	port := t.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(t.Host, strconv.Itoa(port))
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, smtpTimeout)
+		defer cancel()
+	}
+	client, conn, err := t.dial(ctx, addr, port == 465)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	defer client.Close()
+
+	// A server that stops answering fails the read or write in progress
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && port != 465 {
+		if err := client.StartTLS(&tls.Config{ServerName: t.Host}); err != nil {
+			return "", fmt.Errorf("STARTTLS with %s failed: %v", addr, err)
+		}
+	}
+
+	if t.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", t.Username, t.Password, t.Host)); err != nil {
+			return "", fmt.Errorf("authentication with %s failed: %v", addr, err)
+		}
+	}
+
+	if err := client.Mail(envelopeAddress(email.From)); err != nil {
+		return "", fmt.Errorf("MAIL FROM rejected: %v", err)
+	}
+	for _, recipient := range email.Recipients() {
+		if err := client.Rcpt(envelopeAddress(recipient)); err != nil {
+			return "", fmt.Errorf("RCPT TO %s rejected: %v", recipient, err)
+		}
+	}
+
+	reply, err := sendData(client, raw)
+	if err != nil {
+		return "", err
+	}
+	messageID := email.MessageID
+	if region := sesSMTPRegion(t.Host); region != "" {
+		// SES answers "Ok <message ID>"
+		if fields := strings.Fields(reply); len(fields) == 2 && strings.EqualFold(fields[0], "Ok") {
+			messageID = sesRegionMessageID(region, fields[1])
+		}
+	}
+
+	// The message is accepted; a failed QUIT does not undo that
+	client.Quit()
+	return messageID, nil
+}
+
+// sendData sends raw with the DATA command and returns the server's final
+// reply, which net/smtp's Data writer does not expose.
+func sendData(client *smtp.Client, raw []byte) (string, error) {
+	id, err := client.Text.Cmd("DATA")
+	if err != nil {
+		return "", fmt.Errorf("DATA rejected: %v", err)
+	}
+	client.Text.StartResponse(id)
+	_, _, err = client.Text.ReadResponse(354)
+	client.Text.EndResponse(id)
+	if err != nil {
+		return "", fmt.Errorf("DATA rejected: %v", err)
+	}
+
+	writer := client.Text.DotWriter()
+	if _, err := writer.Write(raw); err != nil {
+		return "", fmt.Errorf("failed to write message: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("failed to write message: %v", err)
+	}
+	_, reply, err := client.Text.ReadResponse(250)
+	if err != nil {
+		return "", fmt.Errorf("message rejected: %v", err)
+	}
+	return reply, nil
+}
+
+// sesSMTPRegion returns the region of an SES SMTP endpoint such as
+// email-smtp.eu-west-1.amazonaws.com, or "" for any other host.
+func sesSMTPRegion(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.HasPrefix(host, "email-smtp.") || !strings.HasSuffix(host, ".amazonaws.com") {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "email-smtp."), ".amazonaws.com")
+}
+
+// envelopeAddress returns the bare address of a header address such as
+// "Name <user@example.com>".
+func envelopeAddress(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		return parsed.Address
+	}
+	return address
+}
+
+// dial connects to addr, over TLS from the start if implicitTLS is set, and
+// returns the client and its connection.
+func (t *SMTPTransport) dial(ctx context.Context, addr string, implicitTLS bool) (*smtp.Client, net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if implicitTLS {
+		dialer := &tls.Dialer{Config: &tls.Config{ServerName: t.Host}}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The greeting is read here, so it needs the deadline too
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	client, err := smtp.NewClient(conn, t.Host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return client, conn, nil
+}